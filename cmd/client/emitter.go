@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type batchConf struct {
+	Enabled  bool `json:"enabled"`
+	WindowMs int  `json:"windowMs"`
+	MaxSize  int  `json:"maxSize"`
+}
+
+// emitter turns polled samples into mqtt messages.
+type emitter interface {
+	// Emit hands over one polled sample.
+	Emit(o out)
+	// EndCycle is called after every tag has been polled once.
+	EndCycle()
+	// Close flushes what is still pending.
+	Close()
+}
+
+func newEmitter(conf Conf, pub *publisher, spb *sparkplugNode) emitter {
+	bc := conf.Mqtt.Batch
+	switch {
+	case spb != nil:
+		if !bc.Enabled {
+			bc = batchConf{Enabled: true, MaxSize: 1}
+		}
+		return newBatcher(bc, spb.Data)
+	case bc.Enabled:
+		return newBatcher(bc, jsonBatch(conf.Mqtt.ClientID, pub))
+	}
+	return &tagEmitter{clientID: conf.Mqtt.ClientID, pub: pub}
+}
+
+// tagEmitter publishes one message per tag on devs/{id}/tags/{tag}.
+type tagEmitter struct {
+	clientID string
+	pub      *publisher
+}
+
+func (e *tagEmitter) Emit(o out) {
+	payload, _ := json.Marshal(o)
+	e.pub.Enqueue(fmt.Sprintf("devs/%s/tags/%s", e.clientID, o.TagName), payload, false)
+}
+
+func (e *tagEmitter) EndCycle() {}
+
+func (e *tagEmitter) Close() {}
+
+// jsonBatch publishes an array of samples on devs/{id}/batch.
+func jsonBatch(clientID string, pub *publisher) func([]out) {
+	topic := fmt.Sprintf("devs/%s/batch", clientID)
+	return func(samples []out) {
+		payload, _ := json.Marshal(samples)
+		pub.Enqueue(topic, payload, false)
+	}
+}
+
+// batcher groups samples before handing them to flush. Without a window or
+// size limit a batch is flushed once per poll cycle.
+type batcher struct {
+	conf  batchConf
+	flush func([]out)
+
+	mu      sync.Mutex
+	samples []out
+	timer   *time.Timer
+}
+
+func newBatcher(conf batchConf, flush func([]out)) *batcher {
+	return &batcher{
+		conf:  conf,
+		flush: flush,
+	}
+}
+
+func (b *batcher) Emit(o out) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.samples = append(b.samples, o)
+	if b.conf.MaxSize > 0 && len(b.samples) >= b.conf.MaxSize {
+		b.flushLocked()
+		return
+	}
+	if b.conf.WindowMs > 0 && b.timer == nil {
+		var t *time.Timer
+		t = time.AfterFunc(time.Duration(b.conf.WindowMs)*time.Millisecond, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			// the batch this timer was armed for may already be gone
+			if b.timer == t {
+				b.flushLocked()
+			}
+		})
+		b.timer = t
+	}
+}
+
+func (b *batcher) EndCycle() {
+	if b.conf.WindowMs > 0 || b.conf.MaxSize > 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+func (b *batcher) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+func (b *batcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.samples) == 0 {
+		return
+	}
+	samples := b.samples
+	b.samples = nil
+	b.flush(samples)
+}
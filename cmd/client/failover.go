@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultHoldDownSec      = 60
+	defaultCheckIntervalSec = 5
+)
+
+type brokerConf struct {
+	Addr string `json:"addr"`
+	// Priority orders the brokers, the lowest value is preferred.
+	Priority int `json:"priority"`
+}
+
+type failoverConf struct {
+	// HoldDownSec is how long a preferred broker must stay healthy before
+	// switching back to it.
+	HoldDownSec      int `json:"holdDownSec"`
+	CheckIntervalSec int `json:"checkIntervalSec"`
+}
+
+// brokerManager keeps ha-slave attached to the most preferred healthy
+// broker: it fails over in priority order when the connection drops and
+// returns to a preferred broker once it stayed reachable for the hold-down
+// period.
+type brokerManager struct {
+	conf     Conf
+	brokers  []brokerConf
+	holdDown time.Duration
+	interval time.Duration
+	pub      *publisher
+	spb      *sparkplugNode
+
+	mu           sync.Mutex
+	client       MQTT.Client
+	current      int
+	healthySince []time.Time
+
+	lost chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newBrokerManager(conf Conf, pub *publisher, spb *sparkplugNode) *brokerManager {
+	brokers := append([]brokerConf{}, conf.Mqtt.Brokers...)
+	if len(brokers) == 0 {
+		brokers = []brokerConf{{Addr: conf.Mqtt.Addr}}
+	}
+	sort.SliceStable(brokers, func(i, j int) bool { return brokers[i].Priority < brokers[j].Priority })
+
+	fc := conf.Mqtt.Failover
+	if fc.HoldDownSec <= 0 {
+		fc.HoldDownSec = defaultHoldDownSec
+	}
+	if fc.CheckIntervalSec <= 0 {
+		fc.CheckIntervalSec = defaultCheckIntervalSec
+	}
+	return &brokerManager{
+		conf:         conf,
+		brokers:      brokers,
+		holdDown:     time.Duration(fc.HoldDownSec) * time.Second,
+		interval:     time.Duration(fc.CheckIntervalSec) * time.Second,
+		pub:          pub,
+		spb:          spb,
+		current:      -1,
+		healthySince: make([]time.Time, len(brokers)),
+		lost:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+}
+
+// Start blocks until a broker accepted the connection, then supervises it.
+func (m *brokerManager) Start() {
+	for !m.connectBest() {
+		time.Sleep(1 * time.Second)
+	}
+	m.wg.Add(1)
+	go m.supervise()
+}
+
+// Close stops the supervision and disconnects from the current broker.
+func (m *brokerManager) Close() {
+	close(m.done)
+	m.wg.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.disconnect(m.client)
+}
+
+func (m *brokerManager) supervise() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-m.lost:
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		client, current := m.client, m.current
+		m.mu.Unlock()
+		if client == nil || !client.IsConnectionOpen() {
+			log.Printf("[warn] broker %s lost, failing over", m.brokers[current].Addr)
+			m.connectBest()
+			continue
+		}
+		m.checkPreferred(current)
+	}
+}
+
+// checkPreferred probes the brokers preferred over the current one and
+// switches to the first one healthy for the hold-down period.
+func (m *brokerManager) checkPreferred(current int) {
+	now := time.Now()
+	for i := 0; i < current; i++ {
+		if !m.probe(m.brokers[i]) {
+			m.healthySince[i] = time.Time{}
+			continue
+		}
+		if m.healthySince[i].IsZero() {
+			m.healthySince[i] = now
+		}
+		if now.Sub(m.healthySince[i]) >= m.holdDown {
+			log.Printf("[*] broker %s healthy for %s, switching back", m.brokers[i].Addr, m.holdDown)
+			m.connect(i)
+			return
+		}
+	}
+}
+
+// connectBest connects to the first broker accepting the connection.
+func (m *brokerManager) connectBest() bool {
+	for i := range m.brokers {
+		if m.connect(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// connect attaches to broker i, the previous connection is only closed once
+// the new one is up.
+func (m *brokerManager) connect(i int) bool {
+	broker := m.brokers[i]
+	client, err := mqttConnect(m.conf, broker.Addr, m.spb, func(MQTT.Client, error) {
+		select {
+		case m.lost <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		log.Printf("[error] connect broker %s failed, err:%s", broker.Addr, err.Error())
+		m.healthySince[i] = time.Time{}
+		return false
+	}
+
+	m.mu.Lock()
+	old, previous := m.client, m.current
+	m.client, m.current = client, i
+	m.mu.Unlock()
+
+	m.pub.SetClient(client)
+	if old != nil {
+		m.disconnect(old)
+	}
+	if previous >= 0 && previous != i {
+		brokerFailovers.Inc()
+		brokerInfo.WithLabelValues(m.brokers[previous].Addr).Set(0)
+	}
+	brokerInfo.WithLabelValues(broker.Addr).Set(1)
+	log.Printf("[*] mqtt broker %s connected", broker.Addr)
+	return true
+}
+
+// disconnect closes a client, NDEATH carries the bdSeq the client was opened
+// with as the next session is already born.
+func (m *brokerManager) disconnect(client MQTT.Client) {
+	if client == nil {
+		return
+	}
+	if m.spb != nil {
+		m.spb.Disconnect(client)
+	}
+	if client.IsConnectionOpen() {
+		client.Disconnect(250)
+	}
+}
+
+// probe checks the broker accepts a connection, with a tls handshake for
+// the secure schemes.
+func (m *brokerManager) probe(broker brokerConf) bool {
+	u, err := brokerURL(broker.Addr)
+	if err != nil {
+		return false
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host += ":" + defaultPort(u.Scheme)
+	}
+	dialer := &net.Dialer{Timeout: m.interval}
+	if !isTLS(u) {
+		conn, err := dialer.Dial("tcp", host)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	tlsConfig, err := m.conf.Mqtt.TLS.config()
+	if err != nil {
+		return false
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	conn, err := tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
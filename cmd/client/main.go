@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
@@ -27,18 +28,28 @@ type modbusClient struct {
 	IntervalSec int    `json:"intervalSec"`
 }
 type mqttClient struct {
-	Addr         string `json:"addr"`
-	Topic        string `json:"topic"`
-	ClientID     string `json:"clientId"`
-	CleanSession bool   `json:"cleanSession"`
-	Qos          int    `json:"qos"`
+	Addr         string        `json:"addr"`
+	Brokers      []brokerConf  `json:"brokers"`
+	Failover     failoverConf  `json:"failover"`
+	Topic        string        `json:"topic"`
+	ClientID     string        `json:"clientId"`
+	Username     string        `json:"username"`
+	Password     string        `json:"password"`
+	PasswordFile string        `json:"passwordFile"`
+	TLS          tlsConf       `json:"tls"`
+	CleanSession bool          `json:"cleanSession"`
+	Qos          int           `json:"qos"`
+	Publish      publishConf   `json:"publish"`
+	Batch        batchConf     `json:"batch"`
+	Sparkplug    sparkplugConf `json:"sparkplug"`
 }
 
 // Conf slave configuration
 type Conf struct {
-	Tags   []tag        `json:"tags"`
-	Modbus modbusClient `json:"modbus"`
-	Mqtt   mqttClient   `json:"mqtt"`
+	Tags    []tag        `json:"tags"`
+	Modbus  modbusClient `json:"modbus"`
+	Mqtt    mqttClient   `json:"mqtt"`
+	Metrics metricsConf  `json:"metrics"`
 }
 
 type out struct {
@@ -60,21 +71,24 @@ func main() {
 	}
 	log.Println("[*] configuration load success")
 
-	var mqttClient MQTT.Client
-	for {
-		if mqttClient != nil {
-			mqttClient.Disconnect(0)
-		}
+	var spb *sparkplugNode
+	if conf.Mqtt.Sparkplug.Enabled {
+		// sparkplug hosts check the seq numbering, keep messages ordered
+		conf.Mqtt.Publish.Workers = 1
+	}
+	serveMetrics(conf.Metrics)
+	pub := newPublisher(conf.Mqtt)
+	pub.Start()
+	defer pub.Close()
+	if conf.Mqtt.Sparkplug.Enabled {
+		spb = newSparkplugNode(conf, pub)
+	}
 
-		// mqtt >>>
-		mqttClient, err = mqttConnect(conf)
-		if err != nil {
-			log.Println("[error] create mqtt client failed")
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		log.Println("[*] mqtt broker connected")
+	brokers := newBrokerManager(conf, pub, spb)
+	brokers.Start()
+	defer brokers.Close()
 
+	for {
 		// modbus >>>
 		modbusClient, handler := modbusConnect(conf)
 		if modbusClient == nil || handler == nil {
@@ -85,7 +99,12 @@ func main() {
 		log.Println("[*] modbus connected")
 
 		// run
-		run(conf, modbusClient, handler, mqttClient)
+		em := newEmitter(conf, pub, spb)
+		run(conf, modbusClient, handler, em)
+		em.Close()
+		if spb != nil {
+			spb.DevicesDead()
+		}
 
 		// stop
 		time.Sleep(1 * time.Second)
@@ -93,7 +112,7 @@ func main() {
 	}
 }
 
-func run(conf Conf, modbusClient modbus.Client, handler *modbus.TCPClientHandler, mqttClient MQTT.Client) {
+func run(conf Conf, modbusClient modbus.Client, handler *modbus.TCPClientHandler, em emitter) {
 	for {
 		for _, t := range conf.Tags {
 			log.Printf("[*] tag[%s:%s] polling", t.SrcName, t.TagName)
@@ -113,11 +132,10 @@ func run(conf Conf, modbusClient modbus.Client, handler *modbus.TCPClientHandler
 				int(binary.BigEndian.Uint32(valueBytes)),
 				time.Now().Format(time.RFC3339),
 			}
-			o, _ := json.Marshal(i)
-			token := mqttClient.Publish(fmt.Sprintf("devs/%s/tags/%s", conf.Mqtt.ClientID, t.TagName), byte(conf.Mqtt.Qos), false, o)
-			token.Wait()
+			em.Emit(i)
 			time.Sleep(time.Duration(conf.Modbus.IntervalSec) * time.Second)
 		}
+		em.EndCycle()
 	}
 }
 
@@ -138,17 +156,64 @@ func modbusConnect(conf Conf) (modbus.Client, *modbus.TCPClientHandler) {
 	return modbusClient, handler
 }
 
-func mqttConnect(conf Conf) (MQTT.Client, error) {
+// mqttConnect connects to addr, the paho reconnection is left to the broker
+// manager so that it can fail over to another broker.
+func mqttConnect(conf Conf, addr string, spb *sparkplugNode, onLost MQTT.ConnectionLostHandler) (MQTT.Client, error) {
+	broker, err := brokerURL(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := conf.Mqtt.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+	password := conf.Mqtt.Password
+	if conf.Mqtt.PasswordFile != "" {
+		data, err := ioutil.ReadFile(conf.Mqtt.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("read password file: %s", err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+
 	opts := MQTT.NewClientOptions()
-	opts.AddBroker(conf.Mqtt.Addr)
+	opts.AddBroker(broker.String())
 	opts.SetClientID(conf.Mqtt.ClientID)
 	opts.SetCleanSession(conf.Mqtt.CleanSession)
-	opts.SetWill(fmt.Sprintf("devs/%s/status", conf.Mqtt.ClientID), `{"value":0}`, byte(conf.Mqtt.Qos), true)
+	opts.SetUsername(conf.Mqtt.Username)
+	opts.SetPassword(password)
+	opts.SetAutoReconnect(false)
+	opts.SetConnectionLostHandler(onLost)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	var bdSeq uint64
+	if spb != nil {
+		var topic string
+		var payload []byte
+		topic, payload, bdSeq = spb.DeathCertificate()
+		opts.SetBinaryWill(topic, payload, 1, false)
+		opts.SetOnConnectHandler(spb.OnConnect)
+	} else {
+		opts.SetWill(fmt.Sprintf("devs/%s/status", conf.Mqtt.ClientID), `{"value":0}`, byte(conf.Mqtt.Qos), true)
+	}
 	mqttClient := MQTT.NewClient(opts)
+	if spb != nil {
+		spb.Track(mqttClient, bdSeq, addr)
+	}
 	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
+		if spb != nil {
+			spb.Disconnect(mqttClient)
+		}
+		return nil, explainConnError(broker, tlsConfig, token.Error())
+	}
+	if spb != nil {
+		// NBIRTH replaces the status message
+		return mqttClient, nil
 	}
-	token := mqttClient.Publish(fmt.Sprintf("devs/%s/status", conf.Mqtt.ClientID), byte(conf.Mqtt.Qos), false, `{"value":1}`)
+	// retained like the will, the broker tells the cloud where the gateway is attached
+	status, _ := json.Marshal(map[string]interface{}{"value": 1, "broker": addr})
+	token := mqttClient.Publish(fmt.Sprintf("devs/%s/status", conf.Mqtt.ClientID), byte(conf.Mqtt.Qos), true, status)
 	token.Wait()
 
 	return mqttClient, nil
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type metricsConf struct {
+	Addr string `json:"addr"`
+	Path string `json:"path"`
+}
+
+var (
+	queueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ha_slave_publish_queue_length",
+		Help: "Number of samples waiting in the publish queue.",
+	})
+	queueLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ha_slave_publish_queue_latency_seconds",
+		Help:    "Time a sample spent in the publish queue.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	publishDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ha_slave_publish_duration_seconds",
+		Help:    "Time between handing a message to the broker and its completion.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	inflight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ha_slave_publish_inflight",
+		Help: "Number of publishes waiting for completion.",
+	})
+	published = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ha_slave_published_total",
+		Help: "Number of messages published successfully.",
+	})
+	publishUnacked = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ha_slave_publish_unacked_total",
+		Help: "Number of qos 1/2 publishes not acknowledged in time, left to the client store.",
+	})
+	publishDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ha_slave_publish_dropped_total",
+		Help: "Number of samples dropped before reaching the broker.",
+	}, []string{"reason"})
+	brokerInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ha_slave_mqtt_broker_connected",
+		Help: "Whether the slave is attached to the broker.",
+	}, []string{"broker"})
+	brokerFailovers = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ha_slave_mqtt_broker_switches_total",
+		Help: "Number of times the slave moved to another broker.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		queueLength,
+		queueLatency,
+		publishDuration,
+		inflight,
+		published,
+		publishUnacked,
+		publishDropped,
+		brokerInfo,
+		brokerFailovers,
+	)
+}
+
+// serveMetrics exposes the slave metrics when an address is configured.
+func serveMetrics(conf metricsConf) {
+	if conf.Addr == "" {
+		return
+	}
+	if conf.Path == "" {
+		conf.Path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(conf.Path, promhttp.Handler())
+	go func() {
+		log.Printf("[*] metrics listening on %s%s", conf.Addr, conf.Path)
+		if err := http.ListenAndServe(conf.Addr, mux); err != nil {
+			log.Printf("[error] metrics server stopped, err:%s", err.Error())
+		}
+	}()
+}
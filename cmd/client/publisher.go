@@ -0,0 +1,233 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultQueueSize   = 1000
+	defaultWorkers     = 1
+	defaultMaxInflight = 10
+	defaultTimeoutSec  = 10
+
+	dropOldest = "oldest"
+	dropNewest = "newest"
+)
+
+type publishConf struct {
+	QueueSize   int    `json:"queueSize"`
+	Workers     int    `json:"workers"`
+	MaxInflight int    `json:"maxInflight"`
+	TimeoutSec  int    `json:"timeoutSec"`
+	DropPolicy  string `json:"dropPolicy"`
+}
+
+type message struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+	enqueued time.Time
+	// send publishes the message instead of the payload when set, it
+	// builds it at send time and returns nil to discard it
+	send func(client MQTT.Client) MQTT.Token
+}
+
+// publisher decouples polling from the broker: samples are pushed into a
+// bounded queue and published by a pool of workers, so a slow broker never
+// delays the next modbus read.
+type publisher struct {
+	conf     publishConf
+	qos      byte
+	queue    chan message
+	inflight chan struct{}
+
+	mu     sync.RWMutex
+	client MQTT.Client
+	// changed is closed and replaced whenever the client is swapped
+	changed chan struct{}
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newPublisher(conf mqttClient) *publisher {
+	pc := conf.Publish
+	if pc.QueueSize <= 0 {
+		pc.QueueSize = defaultQueueSize
+	}
+	if pc.Workers <= 0 {
+		pc.Workers = defaultWorkers
+	}
+	if pc.MaxInflight <= 0 {
+		pc.MaxInflight = defaultMaxInflight
+	}
+	if pc.TimeoutSec <= 0 {
+		pc.TimeoutSec = defaultTimeoutSec
+	}
+	if pc.DropPolicy != dropNewest {
+		pc.DropPolicy = dropOldest
+	}
+	return &publisher{
+		conf:     pc,
+		qos:      byte(conf.Qos),
+		queue:    make(chan message, pc.QueueSize),
+		inflight: make(chan struct{}, pc.MaxInflight),
+		changed:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// SetClient swaps the mqtt client used by the workers, queued samples
+// survive a reconnect.
+func (p *publisher) SetClient(client MQTT.Client) {
+	p.mu.Lock()
+	p.client = client
+	close(p.changed)
+	p.changed = make(chan struct{})
+	p.mu.Unlock()
+}
+
+// connectedClient waits for a connected client, the workers hold their
+// sample while the broker is away instead of dropping it. It returns nil
+// once the publisher is closed.
+func (p *publisher) connectedClient() MQTT.Client {
+	for {
+		p.mu.RLock()
+		client, changed := p.client, p.changed
+		p.mu.RUnlock()
+		// a lost client stays closed until the next one is set
+		if client != nil && client.IsConnectionOpen() {
+			return client
+		}
+		select {
+		case <-p.done:
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// Start launches the publisher workers.
+func (p *publisher) Start() {
+	for i := 0; i < p.conf.Workers; i++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+}
+
+// Close stops the workers and waits for the in-flight publishes to settle.
+func (p *publisher) Close() {
+	close(p.done)
+	p.wg.Wait()
+}
+
+// Enqueue never blocks, when the queue is full a sample is dropped
+// according to the drop policy.
+func (p *publisher) Enqueue(topic string, payload []byte, retained bool) {
+	p.enqueue(message{
+		topic:    topic,
+		payload:  payload,
+		qos:      p.qos,
+		retained: retained,
+		enqueued: time.Now(),
+	})
+}
+
+// EnqueueFunc queues a message built when a worker sends it, for messages
+// whose content depends on the order they reach the broker in.
+func (p *publisher) EnqueueFunc(topic string, qos byte, send func(client MQTT.Client) MQTT.Token) {
+	p.enqueue(message{
+		topic:    topic,
+		qos:      qos,
+		enqueued: time.Now(),
+		send:     send,
+	})
+}
+
+func (p *publisher) enqueue(m message) {
+	for {
+		select {
+		case p.queue <- m:
+			queueLength.Set(float64(len(p.queue)))
+			return
+		default:
+		}
+		if p.conf.DropPolicy == dropNewest {
+			publishDropped.WithLabelValues("queue_full").Inc()
+			return
+		}
+		select {
+		case <-p.queue:
+			publishDropped.WithLabelValues("queue_full").Inc()
+		default:
+		}
+	}
+}
+
+func (p *publisher) worker() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.done:
+			return
+		case m := <-p.queue:
+			queueLength.Set(float64(len(p.queue)))
+			client := p.connectedClient()
+			if client == nil {
+				return
+			}
+			queueLatency.Observe(time.Since(m.enqueued).Seconds())
+			p.publish(client, m)
+		}
+	}
+}
+
+func (p *publisher) publish(client MQTT.Client, m message) {
+	p.inflight <- struct{}{}
+	inflight.Inc()
+	start := time.Now()
+	var token MQTT.Token
+	if m.send != nil {
+		token = m.send(client)
+	} else {
+		token = client.Publish(m.topic, m.qos, m.retained, m.payload)
+	}
+	if token == nil {
+		<-p.inflight
+		inflight.Dec()
+		publishDropped.WithLabelValues("discarded").Inc()
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.inflight
+			inflight.Dec()
+			p.wg.Done()
+		}()
+		if !token.WaitTimeout(time.Duration(p.conf.TimeoutSec) * time.Second) {
+			// qos 1/2 messages stay in the client store and are resent by
+			// paho after a reconnect, qos 0 ones are gone.
+			if m.qos == 0 {
+				publishDropped.WithLabelValues("timeout").Inc()
+			} else {
+				publishUnacked.Inc()
+			}
+			log.Printf("[warn] publish %s timed out", m.topic)
+			return
+		}
+		if err := token.Error(); err != nil {
+			publishDropped.WithLabelValues("error").Inc()
+			log.Printf("[error] publish %s failed, err:%s", m.topic, err.Error())
+			return
+		}
+		publishDuration.Observe(time.Since(start).Seconds())
+		published.Inc()
+	}()
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/MOXA-ISD/edge-ha/pkg/sparkplug"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Sparkplug requires births and data at QoS 0, NDEATH is sent at QoS 1 like
+// the Last-Will.
+const (
+	sparkplugQoS      = 0
+	sparkplugDeathQoS = 1
+)
+
+type sparkplugConf struct {
+	Enabled bool   `json:"enabled"`
+	GroupID string `json:"groupId"`
+}
+
+// sparkplugNode publishes the gateway as a Sparkplug B edge node named after
+// the mqtt client id, every distinct srcNmae becomes a device and tags
+// without a source are node metrics.
+type sparkplugNode struct {
+	groupID string
+	nodeID  string
+	tags    []tag
+	aliases map[string]uint64
+	pub     *publisher
+
+	mu       sync.Mutex
+	client   MQTT.Client
+	broker   string
+	sessions uint64
+	bdSeq    uint64
+	seq      uint64
+	last     map[string]out
+	born     map[string]bool
+	// clients maps every open client onto its session, its NDEATH must
+	// carry the bdSeq of that one and not the one of a newer session
+	clients map[MQTT.Client]nodeSession
+}
+
+// nodeSession is the bdSeq and the broker a client was opened with, they
+// become the ones of the node once it is connected.
+type nodeSession struct {
+	bdSeq  uint64
+	broker string
+}
+
+func newSparkplugNode(conf Conf, pub *publisher) *sparkplugNode {
+	n := &sparkplugNode{
+		groupID: conf.Mqtt.Sparkplug.GroupID,
+		nodeID:  conf.Mqtt.ClientID,
+		tags:    conf.Tags,
+		aliases: map[string]uint64{},
+		pub:     pub,
+		clients: map[MQTT.Client]nodeSession{},
+		last:    map[string]out{},
+		born:    map[string]bool{},
+	}
+	if n.groupID == "" {
+		n.groupID = "edge"
+	}
+	for i, t := range conf.Tags {
+		n.aliases[tagKey(t.SrcName, t.TagName)] = uint64(i + 1)
+	}
+	return n
+}
+
+func tagKey(src, tag string) string {
+	return src + "/" + tag
+}
+
+func (n *sparkplugNode) topic(msgType, device string) string {
+	return sparkplug.Topic{Group: n.groupID, Type: msgType, Node: n.nodeID, Device: device}.String()
+}
+
+// DeathCertificate starts a new mqtt session and returns the NDEATH message
+// to register as Last-Will and the bdSeq of the session, it is the one of
+// the NBIRTH once the client connects.
+func (n *sparkplugNode) DeathCertificate() (string, []byte, uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	bdSeq := n.sessions % 256
+	n.sessions++
+	return n.topic(sparkplug.NDEATH, ""), deathPayload(bdSeq), bdSeq
+}
+
+// Track records the session of a client created with a death certificate
+// for the broker at addr.
+func (n *sparkplugNode) Track(client MQTT.Client, bdSeq uint64, addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.clients[client] = nodeSession{bdSeq: bdSeq, broker: addr}
+}
+
+func deathPayload(bdSeq uint64) []byte {
+	p := sparkplug.Payload{
+		Timestamp: nowMillis(),
+		Metrics:   []sparkplug.Metric{sparkplug.NewMetric(sparkplug.BdSeqMetric, sparkplug.UInt64, bdSeq)},
+	}
+	return p.Marshal()
+}
+
+// OnConnect runs on every (re)connect: it subscribes to node commands and
+// publishes the birth certificates with the session of the client, a
+// connect attempt that failed leaves the node as it was.
+func (n *sparkplugNode) OnConnect(client MQTT.Client) {
+	n.mu.Lock()
+	n.client = client
+	if s, ok := n.clients[client]; ok {
+		n.bdSeq, n.broker = s.bdSeq, s.broker
+	}
+	n.mu.Unlock()
+
+	token := client.Subscribe(n.topic(sparkplug.NCMD, ""), 1, n.onCommand)
+	if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+		log.Printf("[error] subscribe sparkplug commands failed, err:%s", token.Error().Error())
+	}
+	n.rebirth()
+}
+
+func (n *sparkplugNode) onCommand(_ MQTT.Client, msg MQTT.Message) {
+	p, err := sparkplug.Unmarshal(msg.Payload())
+	if err != nil {
+		log.Printf("[error] invalid sparkplug command, err:%s", err.Error())
+		return
+	}
+	for _, m := range p.Metrics {
+		if v, ok := m.Value.(bool); ok && v && m.Name == sparkplug.RebirthMetric {
+			log.Println("[*] sparkplug rebirth requested")
+			// never wait for a publish inside the paho message handler
+			go n.rebirth()
+			return
+		}
+	}
+}
+
+// Disconnect publishes NDEATH with the bdSeq of the client session before
+// an intentional disconnect, the broker only sends the Last-Will when the
+// connection drops. The session is forgotten either way.
+func (n *sparkplugNode) Disconnect(client MQTT.Client) {
+	n.mu.Lock()
+	s, ok := n.clients[client]
+	delete(n.clients, client)
+	n.mu.Unlock()
+	if ok && client.IsConnectionOpen() {
+		n.publishNow(client, n.topic(sparkplug.NDEATH, ""), sparkplugDeathQoS, deathPayload(s.bdSeq))
+	}
+}
+
+// DevicesDead publishes DDEATH for every device, used when polling fails.
+func (n *sparkplugNode) DevicesDead() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for device := range n.born {
+		if device == "" {
+			continue
+		}
+		p := sparkplug.Payload{Timestamp: nowMillis(), Seq: n.nextSeq(), HasSeq: true}
+		n.publishNow(n.client, n.topic(sparkplug.DDEATH, device), sparkplugQoS, p.Marshal())
+		delete(n.born, device)
+	}
+}
+
+func (n *sparkplugNode) rebirth() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.seq = 0
+	n.born = map[string]bool{}
+	metrics := []sparkplug.Metric{
+		sparkplug.NewMetric(sparkplug.BdSeqMetric, sparkplug.UInt64, n.bdSeq),
+		sparkplug.NewMetric(sparkplug.RebirthMetric, sparkplug.Boolean, false),
+		sparkplug.NewMetric("Node Info/Broker", sparkplug.String, n.broker),
+	}
+	metrics = append(metrics, n.birthMetrics("")...)
+	p := sparkplug.Payload{Timestamp: nowMillis(), Metrics: metrics, Seq: 0, HasSeq: true}
+	n.seq = 1
+	if !n.publishNow(n.client, n.topic(sparkplug.NBIRTH, ""), sparkplugQoS, p.Marshal()) {
+		return
+	}
+	n.born[""] = true
+
+	for _, device := range n.devices() {
+		n.deviceBirth(device)
+	}
+}
+
+func (n *sparkplugNode) deviceBirth(device string) {
+	p := sparkplug.Payload{Timestamp: nowMillis(), Metrics: n.birthMetrics(device), Seq: n.nextSeq(), HasSeq: true}
+	if n.publishNow(n.client, n.topic(sparkplug.DBIRTH, device), sparkplugQoS, p.Marshal()) {
+		n.born[device] = true
+	}
+}
+
+// birthMetrics lists every tag of a device with its name, alias and last
+// known value, tags not polled yet are sent as null.
+func (n *sparkplugNode) birthMetrics(device string) []sparkplug.Metric {
+	metrics := []sparkplug.Metric{}
+	for _, t := range n.tags {
+		if t.SrcName != device {
+			continue
+		}
+		key := tagKey(t.SrcName, t.TagName)
+		var m sparkplug.Metric
+		if o, ok := n.last[key]; ok {
+			m = n.metric(t.TagName, datatype(t.ValueType), o)
+		} else {
+			m = sparkplug.NewMetric(t.TagName, datatype(t.ValueType), nil)
+			m.Timestamp = nowMillis()
+		}
+		m.Alias, m.HasAlias = n.aliases[key], true
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+func (n *sparkplugNode) devices() []string {
+	devices := []string{}
+	seen := map[string]bool{}
+	for _, t := range n.tags {
+		if t.SrcName == "" || seen[t.SrcName] {
+			continue
+		}
+		seen[t.SrcName] = true
+		devices = append(devices, t.SrcName)
+	}
+	return devices
+}
+
+// Data publishes polled samples as NDATA/DDATA, one message per device,
+// metrics are referenced by alias only.
+func (n *sparkplugNode) Data(samples []out) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	groups := map[string][]sparkplug.Metric{}
+	order := []string{}
+	for _, o := range samples {
+		key := tagKey(o.SrcName, o.TagName)
+		n.last[key] = o
+		alias, ok := n.aliases[key]
+		if !ok {
+			continue
+		}
+		m := n.metric("", n.valueType(o), o)
+		m.Alias, m.HasAlias = alias, true
+		if _, ok := groups[o.SrcName]; !ok {
+			order = append(order, o.SrcName)
+		}
+		groups[o.SrcName] = append(groups[o.SrcName], m)
+	}
+
+	if !n.born[""] {
+		// wait for NBIRTH, the values are part of the births
+		return
+	}
+	for _, device := range order {
+		msgType := sparkplug.DDATA
+		if device == "" {
+			msgType = sparkplug.NDATA
+		} else if !n.born[device] {
+			n.deviceBirth(device)
+			continue
+		}
+		n.enqueueData(n.topic(msgType, device), device, groups[device])
+	}
+}
+
+// enqueueData queues NDATA/DDATA, the seq is only taken when the message is
+// sent: births bypass the queue, data queued before a rebirth must follow
+// the seq of the new NBIRTH.
+func (n *sparkplugNode) enqueueData(topic, device string, metrics []sparkplug.Metric) {
+	ts := nowMillis()
+	n.pub.EnqueueFunc(topic, sparkplugQoS, func(client MQTT.Client) MQTT.Token {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if !n.born[""] || !n.born[device] {
+			// the node or device died meanwhile, the next birth carries
+			// the values
+			return nil
+		}
+		p := sparkplug.Payload{Timestamp: ts, Metrics: metrics, Seq: n.nextSeq(), HasSeq: true}
+		return client.Publish(topic, sparkplugQoS, false, p.Marshal())
+	})
+}
+
+func (n *sparkplugNode) valueType(o out) uint32 {
+	for _, t := range n.tags {
+		if t.SrcName == o.SrcName && t.TagName == o.TagName {
+			return datatype(t.ValueType)
+		}
+	}
+	return sparkplug.Int64
+}
+
+func (n *sparkplugNode) metric(name string, dt uint32, o out) sparkplug.Metric {
+	m := sparkplug.NewMetric(name, dt, o.Value)
+	m.Timestamp = nowMillis()
+	if ts, err := time.Parse(time.RFC3339, o.Ts); err == nil {
+		m.Timestamp = uint64(ts.UnixNano() / int64(time.Millisecond))
+	}
+	return m
+}
+
+func (n *sparkplugNode) nextSeq() uint64 {
+	seq := n.seq
+	n.seq = (n.seq + 1) % 256
+	return seq
+}
+
+// publishNow bypasses the publish queue, births and deaths must not wait
+// behind buffered data.
+func (n *sparkplugNode) publishNow(client MQTT.Client, topic string, qos byte, payload []byte) bool {
+	if client == nil {
+		return false
+	}
+	token := client.Publish(topic, qos, false, payload)
+	if !token.WaitTimeout(10 * time.Second) {
+		log.Printf("[warn] publish %s timed out", topic)
+		return false
+	}
+	if err := token.Error(); err != nil {
+		log.Printf("[error] publish %s failed, err:%s", topic, err.Error())
+		return false
+	}
+	return true
+}
+
+func datatype(valueType string) uint32 {
+	switch valueType {
+	case "float":
+		return sparkplug.Double
+	case "bool":
+		return sparkplug.Boolean
+	}
+	return sparkplug.Int64
+}
+
+func nowMillis() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
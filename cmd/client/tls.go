@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type tlsConf struct {
+	CA                 string `json:"ca"`
+	Cert               string `json:"cert"`
+	Key                string `json:"key"`
+	ServerName         string `json:"serverName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+// config builds the tls configuration of the broker connection, nil when
+// nothing is configured.
+func (c tlsConf) config() (*tls.Config, error) {
+	if c.CA == "" && c.Cert == "" && c.ServerName == "" && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+	conf := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CA != "" {
+		pem, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %s", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %s", c.CA)
+		}
+	}
+	if c.Cert != "" || c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %s", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// brokerURL parses a broker address, a bare host:port means tcp.
+func brokerURL(addr string) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "tcp://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "tcp", "ws", "ssl", "tls", "tcps", "wss":
+		return u, nil
+	}
+	return nil, fmt.Errorf("unsupported broker scheme %s", u.Scheme)
+}
+
+func isTLS(u *url.URL) bool {
+	switch u.Scheme {
+	case "ssl", "tls", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+// defaultPort is the port paho dials when the broker url has none.
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "ws":
+		return "80"
+	case "wss":
+		return "443"
+	case "ssl", "tls", "tcps":
+		return "8883"
+	}
+	return "1883"
+}
+
+// explainConnError replays the tls handshake of a failed connection, paho
+// flattens the handshake error into a string, to tell why it failed.
+func explainConnError(u *url.URL, conf *tls.Config, err error) error {
+	if !isTLS(u) {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host += ":" + defaultPort(u.Scheme)
+	}
+	if conf == nil {
+		conf = &tls.Config{}
+	}
+	conn, herr := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", host, conf)
+	if herr == nil {
+		conn.Close()
+		return err
+	}
+
+	// newer go versions wrap the x509 errors
+	cause := herr
+	for {
+		u, ok := cause.(interface{ Unwrap() error })
+		if !ok || u.Unwrap() == nil {
+			break
+		}
+		cause = u.Unwrap()
+	}
+
+	var reason string
+	switch e := cause.(type) {
+	case x509.UnknownAuthorityError:
+		reason = "the broker certificate is not signed by the configured CA bundle"
+	case x509.HostnameError:
+		reason = fmt.Sprintf("the broker certificate is not valid for %s, set tls.serverName", e.Host)
+	case x509.CertificateInvalidError:
+		reason = "the broker certificate is invalid"
+	case tls.RecordHeaderError:
+		reason = "the broker does not speak tls on this port"
+	default:
+		msg := herr.Error()
+		if !strings.Contains(msg, "bad certificate") && !strings.Contains(msg, "certificate required") {
+			return err
+		}
+		reason = "the broker rejected the client certificate"
+	}
+	return fmt.Errorf("tls handshake with %s failed: %s: %s", host, reason, herr)
+}
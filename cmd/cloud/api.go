@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Labels the latest value API understands.
+const (
+	tagLabel    = "tag"
+	sourceLabel = "src"
+)
+
+// Quality of a latest value.
+const (
+	qualityGood = "good"
+	// qualityBad means the last payload could not be parsed, the value is
+	// the last valid one.
+	qualityBad = "bad"
+	// qualityStale means the device is offline.
+	qualityStale = "stale"
+)
+
+type deviceInfo struct {
+	Device   string    `json:"device"`
+	Up       bool      `json:"up"`
+	LastSeen time.Time `json:"lastSeen,omitempty"`
+	Tags     int       `json:"tags"`
+}
+
+type latestValue struct {
+	Device          string            `json:"device"`
+	Tag             string            `json:"tag"`
+	Source          string            `json:"src,omitempty"`
+	Metric          string            `json:"metric"`
+	Value           float64           `json:"value"`
+	Text            string            `json:"text,omitempty"`
+	Quality         string            `json:"quality"`
+	Updated         time.Time         `json:"updated"`
+	SourceTimestamp *time.Time        `json:"sourceTimestamp,omitempty"`
+	Labels          map[string]string `json:"labels"`
+}
+
+// latestAPI serves the latest value of every series with a device label on
+// /api/v1/devices, /api/v1/devices/{device}/tags and
+// /api/v1/devices/{device}/tags/{tag}, each accepting ?src= to keep a single
+// source. The tag of a series is its "tag" label, or the metric name without
+// one.
+type latestAPI struct {
+	store    *seriesStore
+	presence *PresenceTracker
+}
+
+const apiPrefix = "/api/v1/devices"
+
+func (a *latestAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	src := r.URL.Query().Get("src")
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	parts := []string{}
+	if path != "" {
+		parts = strings.Split(path, "/")
+	}
+	switch {
+	case len(parts) == 0:
+		writeJSON(w, a.devices(src))
+	case len(parts) == 2 && parts[1] == "tags":
+		values := a.values(parts[0], "", src)
+		if len(values) == 0 {
+			http.Error(w, "unknown device", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, values)
+	case len(parts) == 3 && parts[1] == "tags":
+		values := a.values(parts[0], parts[2], src)
+		if len(values) == 0 {
+			http.Error(w, "unknown tag", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, values)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *latestAPI) devices(src string) []deviceInfo {
+	tags := map[string]int{}
+	for _, v := range a.values("", "", src) {
+		tags[v.Device]++
+	}
+	devices := []deviceInfo{}
+	for device, n := range tags {
+		info := deviceInfo{Device: device, Tags: n}
+		if p, ok := a.presence.Get(device); ok {
+			info.Up, info.LastSeen = p.Up, p.LastSeen
+		}
+		devices = append(devices, info)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Device < devices[j].Device })
+	return devices
+}
+
+// values lists the latest values, an empty device or tag matches any.
+func (a *latestAPI) values(device, tag, src string) []latestValue {
+	values := []latestValue{}
+	for _, ss := range a.store.Snapshot() {
+		if ss.device == "" || (device != "" && ss.device != device) {
+			continue
+		}
+		v := newLatestValue(ss, a.presence)
+		if (tag != "" && v.Tag != tag) || (src != "" && v.Source != src) {
+			continue
+		}
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Device != values[j].Device {
+			return values[i].Device < values[j].Device
+		}
+		if values[i].Tag != values[j].Tag {
+			return values[i].Tag < values[j].Tag
+		}
+		return values[i].Metric < values[j].Metric
+	})
+	return values
+}
+
+// newLatestValue describes a series with a device label, the quality only
+// tells about the parsing without a presence tracker.
+func newLatestValue(ss series, presence *PresenceTracker) latestValue {
+	v := latestValue{
+		Device:  ss.device,
+		Tag:     ss.family.Name,
+		Metric:  ss.family.Name,
+		Value:   ss.value,
+		Text:    ss.text,
+		Updated: ss.updated,
+		Labels:  map[string]string{},
+	}
+	for i, l := range ss.family.Labels {
+		v.Labels[l] = ss.labelValues[i]
+	}
+	for i, attr := range ss.family.attributes(ss.device) {
+		if attr != "" {
+			v.Labels[ss.family.attributeLabels[i]] = attr
+		}
+	}
+	if t, ok := v.Labels[tagLabel]; ok {
+		v.Tag = t
+	}
+	v.Source = v.Labels[sourceLabel]
+	if !ss.timestamp.IsZero() {
+		ts := ss.timestamp
+		v.SourceTimestamp = &ts
+	}
+	v.Quality = qualityGood
+	if presence != nil {
+		if p, ok := presence.Get(ss.device); ok && !p.Up {
+			v.Quality = qualityStale
+		}
+	}
+	if ss.invalid {
+		v.Quality = qualityBad
+	}
+	return v
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// authorized checks the bearer token of an admin request, nothing is
+// authorized without a configured token.
+func authorized(r *http.Request, adminToken string) bool {
+	if adminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
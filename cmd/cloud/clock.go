@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+type clockConf struct {
+	// AheadSec is how far a device clock may run ahead of the exporter
+	// before it is flagged.
+	AheadSec float64 `json:"aheadSec"`
+	// BehindSec flags devices whose samples arrive later than this.
+	BehindSec float64 `json:"behindSec"`
+}
+
+// Directions of a skewed device clock.
+const (
+	clockAhead  = "ahead"
+	clockBehind = "behind"
+)
+
+var arrivalDelay = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "edge_sample_arrival_delay_seconds",
+	Help:    "Time between the device timestamp of a sample and its arrival at the exporter.",
+	Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+}, []string{"device"})
+
+// ClockMonitor compares the timestamps devices put on their samples with
+// the arrival time to spot devices with a wrong clock.
+type ClockMonitor struct {
+	ahead  time.Duration
+	behind time.Duration
+
+	delayDesc  *prometheus.Desc
+	skewedDesc *prometheus.Desc
+
+	mu      sync.Mutex
+	devices map[string]time.Duration
+}
+
+// NewClockMonitor get a new one
+func NewClockMonitor(conf clockConf) *ClockMonitor {
+	return &ClockMonitor{
+		ahead:  time.Duration(conf.AheadSec * float64(time.Second)),
+		behind: time.Duration(conf.BehindSec * float64(time.Second)),
+		delayDesc: prometheus.NewDesc(
+			"edge_device_arrival_delay_seconds",
+			"Arrival delay of the last sample of the device, negative when its clock runs ahead.",
+			[]string{"device"},
+			nil,
+		),
+		skewedDesc: prometheus.NewDesc(
+			"edge_device_clock_skewed",
+			"Whether the device clock runs ahead or far behind the exporter.",
+			[]string{"device", "direction"},
+			nil,
+		),
+		devices: map[string]time.Duration{},
+	}
+}
+
+// sourceTime reads the RFC3339 timestamp of a json payload.
+func sourceTime(payload, path string) (time.Time, bool) {
+	r := gjson.Get(payload, path)
+	if r.Type != gjson.String {
+		return time.Time{}, false
+	}
+	ts, err := time.Parse(time.RFC3339Nano, r.Str)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
+func (c *ClockMonitor) skew(delay time.Duration) string {
+	switch {
+	case delay < -c.ahead:
+		return clockAhead
+	case c.behind > 0 && delay > c.behind:
+		return clockBehind
+	}
+	return ""
+}
+
+// Observe records a sample of device stamped ts arriving at arrival.
+func (c *ClockMonitor) Observe(device string, ts, arrival time.Time) {
+	delay := arrival.Sub(ts)
+	arrivalDelay.WithLabelValues(device).Observe(delay.Seconds())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev, seen := c.devices[device]
+	c.devices[device] = delay
+	if skew := c.skew(delay); skew != "" && (!seen || c.skew(prev) != skew) {
+		log.Printf("clock of %s runs %s by %s", device, skew, delay)
+	}
+}
+
+// Forget drops the last delay and the skew of a device gone offline or
+// purged, they are recorded again once its samples come back. Its arrival
+// delay histogram is kept.
+func (c *ClockMonitor) Forget(device string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.devices, device)
+}
+
+// Describe sends the descriptors of the clock metrics.
+func (c *ClockMonitor) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.delayDesc
+	ch <- c.skewedDesc
+}
+
+// Collect exports the last delay and clock state of every device.
+func (c *ClockMonitor) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for device, delay := range c.devices {
+		skew := c.skew(delay)
+		ch <- prometheus.MustNewConstMetric(c.delayDesc, prometheus.GaugeValue, delay.Seconds(), device)
+		ch <- prometheus.MustNewConstMetric(c.skewedDesc, prometheus.GaugeValue, boolValue(skew == clockAhead), device, clockAhead)
+		ch <- prometheus.MustNewConstMetric(c.skewedDesc, prometheus.GaugeValue, boolValue(skew == clockBehind), device, clockBehind)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MOXA-ISD/edge-ha/pkg/broker"
+	"github.com/MOXA-ISD/edge-ha/pkg/sparkplug"
+)
+
+// Conf exporter configuration
+type Conf struct {
+	Mqtt      mqttConf       `json:"mqtt"`
+	HTTP      httpConf       `json:"http"`
+	Metrics   []*topicMetric `json:"metrics"`
+	Expiry    expiryConf     `json:"expiry"`
+	Presence  presenceConf   `json:"presence"`
+	Clock     clockConf      `json:"clock"`
+	Stream    streamConf     `json:"stream"`
+	Historian historianConf  `json:"historian"`
+	// Relabel maps incoming topics onto metrics ahead of the built-in
+	// handling, for topic schemes other than devs/{id}/....
+	Relabel []*relabelRule `json:"relabel"`
+	// Sinks forward the processed samples to other systems.
+	Sinks []sinkConf `json:"sinks"`
+	// RemoteWrite pushes every sample to a Prometheus remote_write
+	// endpoint.
+	RemoteWrite remoteWriteConf `json:"remoteWrite"`
+	// Registry joins the attributes of the devices onto their metrics.
+	Registry registryConf `json:"registry"`
+	// Limits protect the exporter from devices flooding it with messages or
+	// series.
+	Limits limitsConf `json:"limits"`
+	// Broker runs an MQTT broker inside the exporter instead of subscribing
+	// to an external one.
+	Broker embeddedBrokerConf `json:"broker"`
+	// SysTopics ingests the broker statistics published on $SYS/broker.
+	SysTopics bool `json:"sysTopics"`
+}
+
+type mqttConf struct {
+	// Brokers are tried in order, e.g. tcp://host:1883 or ssl://host:8883.
+	Brokers       []string       `json:"brokers"`
+	ClientID      string         `json:"clientId"`
+	Username      string         `json:"username"`
+	Password      string         `json:"password"`
+	TLS           tlsConf        `json:"tls"`
+	Subscriptions []subscription `json:"subscriptions"`
+}
+
+type embeddedBrokerConf struct {
+	Enabled bool `json:"enabled"`
+	broker.Config
+}
+
+type tlsConf struct {
+	CA                 string `json:"ca"`
+	Cert               string `json:"cert"`
+	Key                string `json:"key"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+type subscription struct {
+	Topic string `json:"topic"`
+	Qos   byte   `json:"qos"`
+}
+
+type httpConf struct {
+	Addr        string `json:"addr"`
+	MetricsPath string `json:"metricsPath"`
+}
+
+type expiryConf struct {
+	// IntervalSec is how often series are checked against their TTL.
+	IntervalSec int `json:"intervalSec"`
+	// StatusTopic is the topic pattern devices report their status on, the
+	// series of a device are dropped when it reports OfflineValue.
+	StatusTopic  string  `json:"statusTopic"`
+	OfflineValue float64 `json:"offlineValue"`
+}
+
+// override is a setting that can be given by flag or environment variable,
+// flags win over the environment which wins over the file.
+type override struct {
+	flag  string
+	env   string
+	usage string
+	apply func(conf *Conf, v string) error
+	value *string
+}
+
+var overrides = []*override{
+	{flag: "broker", env: "MQTT_EXPORTER_BROKERS", usage: "comma separated broker urls", apply: func(c *Conf, v string) error {
+		c.Mqtt.Brokers = splitList(v)
+		return nil
+	}},
+	{flag: "client-id", env: "MQTT_EXPORTER_CLIENT_ID", usage: "mqtt client id", apply: func(c *Conf, v string) error {
+		c.Mqtt.ClientID = v
+		return nil
+	}},
+	{flag: "username", env: "MQTT_EXPORTER_USERNAME", usage: "mqtt username", apply: func(c *Conf, v string) error {
+		c.Mqtt.Username = v
+		return nil
+	}},
+	{flag: "password", env: "MQTT_EXPORTER_PASSWORD", usage: "mqtt password", apply: func(c *Conf, v string) error {
+		c.Mqtt.Password = v
+		return nil
+	}},
+	{flag: "tls-ca", env: "MQTT_EXPORTER_TLS_CA", usage: "CA bundle to verify the broker", apply: func(c *Conf, v string) error {
+		c.Mqtt.TLS.CA = v
+		return nil
+	}},
+	{flag: "tls-cert", env: "MQTT_EXPORTER_TLS_CERT", usage: "client certificate", apply: func(c *Conf, v string) error {
+		c.Mqtt.TLS.Cert = v
+		return nil
+	}},
+	{flag: "tls-key", env: "MQTT_EXPORTER_TLS_KEY", usage: "client certificate key", apply: func(c *Conf, v string) error {
+		c.Mqtt.TLS.Key = v
+		return nil
+	}},
+	{flag: "subscribe", env: "MQTT_EXPORTER_SUBSCRIPTIONS", usage: "comma separated topic filters, optionally suffixed by :qos", apply: func(c *Conf, v string) error {
+		subs, err := parseSubscriptions(v)
+		c.Mqtt.Subscriptions = subs
+		return err
+	}},
+	{flag: "embedded-broker", env: "MQTT_EXPORTER_EMBEDDED_BROKER", usage: "run the in-process broker, true or false", apply: func(c *Conf, v string) error {
+		enabled, err := strconv.ParseBool(v)
+		c.Broker.Enabled = enabled
+		return err
+	}},
+	{flag: "listen", env: "MQTT_EXPORTER_LISTEN", usage: "http listen address", apply: func(c *Conf, v string) error {
+		c.HTTP.Addr = v
+		return nil
+	}},
+	{flag: "metrics-path", env: "MQTT_EXPORTER_METRICS_PATH", usage: "http path of the metrics", apply: func(c *Conf, v string) error {
+		c.HTTP.MetricsPath = v
+		return nil
+	}},
+}
+
+func init() {
+	for _, o := range overrides {
+		o.value = flag.String(o.flag, "", fmt.Sprintf("%s (env %s)", o.usage, o.env))
+	}
+}
+
+// configFile returns the configuration path, the -config flag wins over
+// MQTT_EXPORTER_CONFIG.
+func configFile() string {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == "config"
+	})
+	if env := os.Getenv("MQTT_EXPORTER_CONFIG"); env != "" && !set {
+		return env
+	}
+	return *configPath
+}
+
+// loadConf reads the configuration file, a missing file keeps the built-in
+// defaults, then applies the environment and flag overrides.
+func loadConf(path string) (Conf, error) {
+	conf := Conf{
+		Mqtt: mqttConf{
+			Brokers: []string{"tcp://127.0.0.1:1883"},
+			Subscriptions: []subscription{
+				{Topic: "devs/#"},
+				{Topic: sparkplug.Namespace + "/#"},
+			},
+		},
+		HTTP: httpConf{
+			Addr:        "0.0.0.0:2112",
+			MetricsPath: "/metrics",
+		},
+		Expiry: expiryConf{
+			IntervalSec: 30,
+			StatusTopic: "devs/+/status",
+		},
+		Clock: clockConf{
+			AheadSec:  2,
+			BehindSec: 300,
+		},
+		Broker: embeddedBrokerConf{
+			Config: broker.Config{
+				Listeners: []broker.Listener{{Addr: "0.0.0.0:1883"}},
+			},
+		},
+		SysTopics: true,
+	}
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		log.Printf("No configuration at %s, using defaults", path)
+	case err != nil:
+		return conf, err
+	default:
+		if err := json.Unmarshal(data, &conf); err != nil {
+			return conf, err
+		}
+	}
+	if conf.Metrics == nil {
+		// the defaults are copied, decoding into them would merge the
+		// metrics of the file into the shared defaults
+		for _, m := range defaultTopicMetrics {
+			c := *m
+			conf.Metrics = append(conf.Metrics, &c)
+		}
+	}
+
+	for _, o := range overrides {
+		if v := os.Getenv(o.env); v != "" {
+			if err := o.apply(&conf, v); err != nil {
+				return conf, fmt.Errorf("%s: %s", o.env, err)
+			}
+		}
+	}
+	var flagErr error
+	flag.Visit(func(f *flag.Flag) {
+		for _, o := range overrides {
+			if o.flag == f.Name && flagErr == nil {
+				if err := o.apply(&conf, *o.value); err != nil {
+					flagErr = fmt.Errorf("-%s: %s", o.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return conf, flagErr
+	}
+
+	if len(conf.Mqtt.Brokers) == 0 && !conf.Broker.Enabled {
+		return conf, fmt.Errorf("mqtt: at least one broker is required")
+	}
+	for i, m := range conf.Metrics {
+		if m.Pattern == "" || m.Name == "" {
+			return conf, fmt.Errorf("metrics[%d]: topic and name are required", i)
+		}
+		if len(m.Fields) > 0 && m.Format == formatText {
+			return conf, fmt.Errorf("metrics[%d]: fields require json payloads", i)
+		}
+		if m.TTL != "" {
+			if m.ttl, err = time.ParseDuration(m.TTL); err != nil {
+				return conf, fmt.Errorf("metrics[%d]: invalid ttl: %s", i, err)
+			}
+		}
+	}
+	for i, r := range conf.Relabel {
+		if err := r.compile(); err != nil {
+			return conf, fmt.Errorf("relabel[%d]: %s", i, err)
+		}
+	}
+	return conf, nil
+}
+
+func splitList(v string) []string {
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseSubscriptions reads "devs/#:1,spBv1.0/#", qos defaults to 0.
+func parseSubscriptions(v string) ([]subscription, error) {
+	subs := []subscription{}
+	for _, item := range splitList(v) {
+		sub := subscription{Topic: item}
+		if i := strings.LastIndex(item, ":"); i >= 0 {
+			if qos, err := strconv.Atoi(item[i+1:]); err == nil {
+				if qos < 0 || qos > 2 {
+					return nil, fmt.Errorf("invalid qos in %s", item)
+				}
+				sub.Topic, sub.Qos = item[:i], byte(qos)
+			}
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// tlsConfig builds the tls configuration of the broker connection, nil when
+// nothing is configured.
+func (c tlsConf) tlsConfig() (*tls.Config, error) {
+	if c.CA == "" && c.Cert == "" && !c.InsecureSkipVerify {
+		return nil, nil
+	}
+	conf := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CA != "" {
+		pem, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", c.CA)
+		}
+	}
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
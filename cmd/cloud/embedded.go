@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+
+	"github.com/MOXA-ISD/edge-ha/pkg/broker"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// startEmbeddedBroker runs the in-process broker, the messages matching the
+// subscriptions are handed to the metrics pipeline as they are published.
+func startEmbeddedBroker(subscriptions map[string]byte) {
+	b := broker.New(conf.Broker.Config)
+	b.OnPublish = func(topic string, payload []byte, _ bool) {
+		for filter := range subscriptions {
+			if broker.Match(filter, topic) {
+				handleMessage(topic, payload)
+				return
+			}
+		}
+	}
+	err := b.Start()
+	fatalfOnError(err, "Failed to start the embedded broker: %s", err)
+	log.Printf("Embedded broker started")
+	brokerConnected.Set(1)
+	prometheus.MustRegister(newBrokerCollector(b))
+}
+
+// brokerCollector exports the embedded broker statistics under the names
+// of the mosquitto $SYS metrics.
+type brokerCollector struct {
+	broker *broker.Broker
+
+	clientsConnected *prometheus.Desc
+	clientsTotal     *prometheus.Desc
+	subscriptions    *prometheus.Desc
+	retained         *prometheus.Desc
+	received         *prometheus.Desc
+	sent             *prometheus.Desc
+	bytesReceived    *prometheus.Desc
+	bytesSent        *prometheus.Desc
+}
+
+func newBrokerCollector(b *broker.Broker) *brokerCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(name, help, nil, nil)
+	}
+	return &brokerCollector{
+		broker:           b,
+		clientsConnected: desc("mosquitto_clients_connected", "Number of connected clients."),
+		clientsTotal:     desc("mosquitto_clients_total", "Number of active and inactive clients."),
+		subscriptions:    desc("mosquitto_subscriptions", "Number of subscriptions on the broker."),
+		retained:         desc("mosquitto_retained_messages", "Number of retained messages on the broker."),
+		received:         desc("mosquitto_publish_messages_received_total", "Number of PUBLISH messages received since the broker started."),
+		sent:             desc("mosquitto_publish_messages_sent_total", "Number of PUBLISH messages sent since the broker started."),
+		bytesReceived:    desc("mosquitto_publish_bytes_received_total", "Number of PUBLISH payload bytes received since the broker started."),
+		bytesSent:        desc("mosquitto_publish_bytes_sent_total", "Number of PUBLISH payload bytes sent since the broker started."),
+	}
+}
+
+// Describe sends the descriptors of the broker metrics.
+func (c *brokerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.clientsConnected
+	ch <- c.clientsTotal
+	ch <- c.subscriptions
+	ch <- c.retained
+	ch <- c.received
+	ch <- c.sent
+	ch <- c.bytesReceived
+	ch <- c.bytesSent
+}
+
+// Collect exports the current broker statistics.
+func (c *brokerCollector) Collect(ch chan<- prometheus.Metric) {
+	st := c.broker.Stats()
+	ch <- prometheus.MustNewConstMetric(c.clientsConnected, prometheus.GaugeValue, float64(st.ClientsConnected))
+	ch <- prometheus.MustNewConstMetric(c.clientsTotal, prometheus.GaugeValue, float64(st.Sessions))
+	ch <- prometheus.MustNewConstMetric(c.subscriptions, prometheus.GaugeValue, float64(st.Subscriptions))
+	ch <- prometheus.MustNewConstMetric(c.retained, prometheus.GaugeValue, float64(st.Retained))
+	ch <- prometheus.MustNewConstMetric(c.received, prometheus.CounterValue, float64(st.MessagesReceived))
+	ch <- prometheus.MustNewConstMetric(c.sent, prometheus.CounterValue, float64(st.MessagesSent))
+	ch <- prometheus.MustNewConstMetric(c.bytesReceived, prometheus.CounterValue, float64(st.BytesReceived))
+	ch <- prometheus.MustNewConstMetric(c.bytesSent, prometheus.CounterValue, float64(st.BytesSent))
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Tiers of the historian.
+const (
+	tierRaw    = "raw"
+	tierMinute = "1m"
+	tierHour   = "1h"
+	tierAuto   = "auto"
+)
+
+type historianConf struct {
+	Enabled bool `json:"enabled"`
+	// Path of the file the history is saved to, empty keeps it in memory
+	// only.
+	Path string `json:"path"`
+	// Retention of the raw samples and of the 1m and 1h aggregates, e.g.
+	// "24h".
+	RawRetention    string `json:"rawRetention"`
+	MinuteRetention string `json:"minuteRetention"`
+	HourRetention   string `json:"hourRetention"`
+	// MaxRawPoints bounds the raw samples kept per series.
+	MaxRawPoints int `json:"maxRawPoints"`
+	// SaveIntervalSec is how often the retention is applied and the history
+	// saved.
+	SaveIntervalSec int `json:"saveIntervalSec"`
+
+	raw, minute, hour time.Duration
+}
+
+type rawPoint struct {
+	T int64 // unix milliseconds
+	V float64
+}
+
+type aggPoint struct {
+	T     int64 // start of the bucket, unix milliseconds
+	Min   float64
+	Max   float64
+	Sum   float64
+	Count int
+}
+
+// histSeries is the history of one series, the points are sorted by time.
+type histSeries struct {
+	Device string
+	Tag    string
+	Metric string
+	Source string
+	Raw    []rawPoint
+	Minute []aggPoint
+	Hour   []aggPoint
+}
+
+// Historian records every sample with its source timestamp and keeps
+// downsampled min/max/avg tiers for the longer ranges.
+type Historian struct {
+	conf historianConf
+
+	mu     sync.Mutex
+	series map[string]*histSeries
+}
+
+// NewHistorian loads the saved history if any.
+func NewHistorian(conf historianConf) (*Historian, error) {
+	var err error
+	durations := []struct {
+		v   string
+		def time.Duration
+		out *time.Duration
+	}{
+		{conf.RawRetention, 24 * time.Hour, &conf.raw},
+		{conf.MinuteRetention, 30 * 24 * time.Hour, &conf.minute},
+		{conf.HourRetention, 365 * 24 * time.Hour, &conf.hour},
+	}
+	for _, d := range durations {
+		*d.out = d.def
+		if d.v != "" {
+			if *d.out, err = time.ParseDuration(d.v); err != nil {
+				return nil, fmt.Errorf("historian: invalid retention %s: %s", d.v, err)
+			}
+		}
+	}
+	if conf.MaxRawPoints <= 0 {
+		conf.MaxRawPoints = 100000
+	}
+	if conf.SaveIntervalSec <= 0 {
+		conf.SaveIntervalSec = 60
+	}
+
+	h := &Historian{conf: conf, series: map[string]*histSeries{}}
+	if conf.Path != "" {
+		if err := os.MkdirAll(filepath.Dir(conf.Path), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.Open(conf.Path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		default:
+			defer f.Close()
+			if err := gob.NewDecoder(f).Decode(&h.series); err != nil {
+				return nil, fmt.Errorf("historian: load %s: %s", conf.Path, err)
+			}
+			log.Printf("Loaded the history of %d series from %s", len(h.series), conf.Path)
+		}
+	}
+	return h, nil
+}
+
+// Record adds the sample of an updated series, only the numeric series of
+// a device are recorded.
+func (h *Historian) Record(ss series) {
+	if ss.device == "" || ss.family.Type == typeInfo || ss.family.Type == typeStateSet {
+		return
+	}
+	ts := ss.timestamp
+	if ts.IsZero() {
+		ts = ss.updated
+	}
+	t := ts.UnixNano() / int64(time.Millisecond)
+	key := seriesKey(ss.family, ss.labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hs := h.series[key]
+	if hs == nil {
+		v := newLatestValue(ss, nil)
+		hs = &histSeries{Device: v.Device, Tag: v.Tag, Metric: v.Metric, Source: v.Source}
+		h.series[key] = hs
+	}
+	i := sort.Search(len(hs.Raw), func(i int) bool { return hs.Raw[i].T > t })
+	hs.Raw = append(hs.Raw, rawPoint{})
+	copy(hs.Raw[i+1:], hs.Raw[i:])
+	hs.Raw[i] = rawPoint{T: t, V: ss.value}
+	if len(hs.Raw) > h.conf.MaxRawPoints {
+		hs.Raw = hs.Raw[len(hs.Raw)-h.conf.MaxRawPoints:]
+	}
+	hs.Minute = aggregate(hs.Minute, t-t%int64(time.Minute/time.Millisecond), ss.value)
+	hs.Hour = aggregate(hs.Hour, t-t%int64(time.Hour/time.Millisecond), ss.value)
+}
+
+// aggregate adds v to the bucket starting at t.
+func aggregate(points []aggPoint, t int64, v float64) []aggPoint {
+	i := sort.Search(len(points), func(i int) bool { return points[i].T >= t })
+	if i == len(points) || points[i].T != t {
+		points = append(points, aggPoint{})
+		copy(points[i+1:], points[i:])
+		points[i] = aggPoint{T: t, Min: v, Max: v}
+	}
+	p := &points[i]
+	if v < p.Min {
+		p.Min = v
+	}
+	if v > p.Max {
+		p.Max = v
+	}
+	p.Sum += v
+	p.Count++
+	return points
+}
+
+// Run applies the retention and saves the history periodically.
+func (h *Historian) Run() {
+	for now := range time.Tick(time.Duration(h.conf.SaveIntervalSec) * time.Second) {
+		h.expire(now)
+		if err := h.save(); err != nil {
+			log.Printf("Failed to save the history: %s", err)
+		}
+	}
+}
+
+func (h *Historian) expire(now time.Time) {
+	ms := func(d time.Duration) int64 { return now.Add(-d).UnixNano() / int64(time.Millisecond) }
+	raw, minute, hour := ms(h.conf.raw), ms(h.conf.minute), ms(h.conf.hour)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, hs := range h.series {
+		i := sort.Search(len(hs.Raw), func(i int) bool { return hs.Raw[i].T >= raw })
+		hs.Raw = append([]rawPoint{}, hs.Raw[i:]...)
+		hs.Minute = trimAgg(hs.Minute, minute)
+		hs.Hour = trimAgg(hs.Hour, hour)
+		if len(hs.Raw) == 0 && len(hs.Minute) == 0 && len(hs.Hour) == 0 {
+			delete(h.series, key)
+		}
+	}
+}
+
+func trimAgg(points []aggPoint, cutoff int64) []aggPoint {
+	i := sort.Search(len(points), func(i int) bool { return points[i].T >= cutoff })
+	return append([]aggPoint{}, points[i:]...)
+}
+
+// save writes the history to a temporary file renamed over the previous one.
+// The history is encoded in memory under the lock, the ingestion does not
+// wait for the disk.
+func (h *Historian) save() error {
+	if h.conf.Path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	h.mu.Lock()
+	err := gob.NewEncoder(&buf).Encode(h.series)
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.Create(filepath.Join(filepath.Dir(h.conf.Path), "."+filepath.Base(h.conf.Path)+".tmp"))
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), h.conf.Path)
+}
+
+type historyPoint struct {
+	T     time.Time `json:"t"`
+	Value *float64  `json:"value,omitempty"`
+	Min   *float64  `json:"min,omitempty"`
+	Max   *float64  `json:"max,omitempty"`
+	Avg   *float64  `json:"avg,omitempty"`
+	Count int       `json:"count,omitempty"`
+}
+
+type historyResult struct {
+	Device string         `json:"device"`
+	Tag    string         `json:"tag"`
+	Metric string         `json:"metric"`
+	Source string         `json:"src,omitempty"`
+	Tier   string         `json:"tier"`
+	Points []historyPoint `json:"points"`
+}
+
+type historyQuery struct {
+	device, tag, metric, source string
+	from, to                    time.Time
+	tier                        string
+}
+
+// pickTier chooses the finest tier still covering the range.
+func (h *Historian) pickTier(q historyQuery) string {
+	since := time.Since(q.from)
+	switch {
+	case since <= h.conf.raw && q.to.Sub(q.from) <= 6*time.Hour:
+		return tierRaw
+	case since <= h.conf.minute && q.to.Sub(q.from) <= 7*24*time.Hour:
+		return tierMinute
+	}
+	return tierHour
+}
+
+// Query returns the points of the matching series within the range.
+func (h *Historian) Query(q historyQuery) []historyResult {
+	if q.tier == "" || q.tier == tierAuto {
+		q.tier = h.pickTier(q)
+	}
+	from, to := q.from.UnixNano()/int64(time.Millisecond), q.to.UnixNano()/int64(time.Millisecond)
+	toTime := func(t int64) time.Time { return time.Unix(0, t*int64(time.Millisecond)).UTC() }
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	results := []historyResult{}
+	for _, hs := range h.series {
+		if (q.device != "" && hs.Device != q.device) || (q.tag != "" && hs.Tag != q.tag) ||
+			(q.metric != "" && hs.Metric != q.metric) || (q.source != "" && hs.Source != q.source) {
+			continue
+		}
+		r := historyResult{Device: hs.Device, Tag: hs.Tag, Metric: hs.Metric, Source: hs.Source, Tier: q.tier, Points: []historyPoint{}}
+		if q.tier == tierRaw {
+			for _, p := range hs.Raw {
+				if p.T >= from && p.T <= to {
+					v := p.V
+					r.Points = append(r.Points, historyPoint{T: toTime(p.T), Value: &v})
+				}
+			}
+		} else {
+			points, width := hs.Minute, int64(time.Minute/time.Millisecond)
+			if q.tier == tierHour {
+				points, width = hs.Hour, int64(time.Hour/time.Millisecond)
+			}
+			for _, p := range points {
+				// the buckets overlapping the range
+				if p.T+width > from && p.T <= to {
+					min, max, avg := p.Min, p.Max, p.Sum/float64(p.Count)
+					r.Points = append(r.Points, historyPoint{T: toTime(p.T), Min: &min, Max: &max, Avg: &avg, Count: p.Count})
+				}
+			}
+		}
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Device != b.Device {
+			return a.Device < b.Device
+		}
+		if a.Tag != b.Tag {
+			return a.Tag < b.Tag
+		}
+		return a.Metric+a.Source < b.Metric+b.Source
+	})
+	return results
+}
+
+// parseTime reads an RFC3339 time or unix seconds.
+func parseTime(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// ServeHTTP answers range queries on /api/v1/history with the device, tag,
+// metric, src, from, to (RFC3339 or unix seconds, the last hour by default)
+// and tier (raw, 1m, 1h or auto) parameters, format=csv exports the points
+// as CSV.
+func (h *Historian) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := historyQuery{
+		device: params.Get("device"),
+		tag:    params.Get("tag"),
+		metric: params.Get("metric"),
+		source: params.Get("src"),
+		tier:   params.Get("tier"),
+	}
+	var err error
+	if q.to, err = parseTime(params.Get("to"), time.Now()); err != nil {
+		http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.from, err = parseTime(params.Get("from"), q.to.Add(-time.Hour)); err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch q.tier {
+	case "", tierAuto, tierRaw, tierMinute, tierHour:
+	default:
+		http.Error(w, "invalid tier "+q.tier, http.StatusBadRequest)
+		return
+	}
+
+	results := h.Query(q)
+	if params.Get("format") != "csv" {
+		writeJSON(w, results)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="history.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"device", "tag", "metric", "src", "tier", "timestamp", "value", "min", "max", "avg", "count"})
+	format := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'g', -1, 64)
+	}
+	for _, res := range results {
+		for _, p := range res.Points {
+			count := ""
+			if p.Count > 0 {
+				count = strconv.Itoa(p.Count)
+			}
+			cw.Write([]string{res.Device, res.Tag, res.Metric, res.Source, res.Tier, p.T.Format(time.RFC3339Nano),
+				format(p.Value), format(p.Min), format(p.Max), format(p.Avg), count})
+		}
+	}
+	cw.Flush()
+}
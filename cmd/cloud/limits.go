@@ -0,0 +1,317 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons a message or a new series is rejected.
+const (
+	rejectRateLimit         = "rate_limit"
+	rejectDeviceRateLimit   = "device_rate_limit"
+	rejectSeriesLimit       = "series_limit"
+	rejectDeviceSeriesLimit = "device_series_limit"
+	rejectQuarantined       = "quarantined"
+)
+
+// maxOffendingTopics bounds the topics kept per quarantined device.
+const maxOffendingTopics = 20
+
+// pruneInterval is how often the idle device quotas are dropped.
+const pruneInterval = time.Minute
+
+type limitsConf struct {
+	// MaxSeries bounds the series held by the exporter, new series are
+	// rejected past it.
+	MaxSeries int `json:"maxSeries"`
+	// MaxSeriesPerDevice bounds the series of a device, a device going
+	// past it is quarantined.
+	MaxSeriesPerDevice int `json:"maxSeriesPerDevice"`
+	// MaxMessagesPerSec and MaxDeviceMessagesPerSec bound the messages
+	// accepted overall and from a device, the excess is rejected.
+	MaxMessagesPerSec       float64 `json:"maxMessagesPerSec"`
+	MaxDeviceMessagesPerSec float64 `json:"maxDeviceMessagesPerSec"`
+	// QuarantineSec releases a quarantined device after this long, 0 keeps
+	// it until released through the API.
+	QuarantineSec int `json:"quarantineSec"`
+	// AdminToken is the bearer token releasing devices through the API,
+	// the quarantine can only be listed without it.
+	AdminToken string `json:"adminToken"`
+}
+
+func (c limitsConf) enabled() bool {
+	return c.MaxSeries > 0 || c.MaxSeriesPerDevice > 0 || c.MaxMessagesPerSec > 0 || c.MaxDeviceMessagesPerSec > 0
+}
+
+var (
+	rejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_exporter_rejected_total",
+		Help: "Number of messages and new series rejected by the limits.",
+	}, []string{"reason"})
+	quarantinedDevices = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_exporter_quarantined_devices",
+		Help: "Number of devices currently quarantined.",
+	})
+)
+
+// tokenBucket allows rate events per second, with bursts of a second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(rate float64, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else if b.tokens += now.Sub(b.last).Seconds() * rate; b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type deviceQuota struct {
+	series int
+	bucket tokenBucket
+}
+
+type quarantine struct {
+	Device string    `json:"device"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	// Until is when the device is released, unset until released through
+	// the API.
+	Until *time.Time `json:"until,omitempty"`
+	// Topics are the first topics the device was rejected for.
+	Topics   []string `json:"topics"`
+	Rejected uint64   `json:"rejected"`
+	Series   int      `json:"series"`
+}
+
+// Limits guards the exporter against devices flooding it with messages or
+// series. A device creating more series than allowed is quarantined, all
+// its messages are rejected until it is released.
+type Limits struct {
+	conf limitsConf
+
+	mu         sync.Mutex
+	series     int
+	bucket     tokenBucket
+	devices    map[string]*deviceQuota
+	quarantine map[string]*quarantine
+	// warned is set once the global series limit was logged
+	warned bool
+	pruned time.Time
+}
+
+// NewLimits get a new one
+func NewLimits(conf limitsConf) *Limits {
+	return &Limits{
+		conf:       conf,
+		devices:    map[string]*deviceQuota{},
+		quarantine: map[string]*quarantine{},
+	}
+}
+
+func (l *Limits) device(device string) *deviceQuota {
+	q := l.devices[device]
+	if q == nil {
+		q = &deviceQuota{}
+		l.devices[device] = q
+	}
+	return q
+}
+
+// AllowMessage applies the global message rate.
+func (l *Limits) AllowMessage() bool {
+	if l.conf.MaxMessagesPerSec <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.bucket.allow(l.conf.MaxMessagesPerSec, time.Now()) {
+		rejected.WithLabelValues(rejectRateLimit).Inc()
+		return false
+	}
+	return true
+}
+
+// AllowDevice rejects the messages of a quarantined device and applies the
+// device message rate.
+func (l *Limits) AllowDevice(device, topic string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.quarantined(device, topic, now) {
+		return false
+	}
+	if l.conf.MaxDeviceMessagesPerSec <= 0 {
+		return true
+	}
+	if now.Sub(l.pruned) > pruneInterval {
+		l.prune(now)
+	}
+	if !l.device(device).bucket.allow(l.conf.MaxDeviceMessagesPerSec, now) {
+		rejected.WithLabelValues(rejectDeviceRateLimit).Inc()
+		return false
+	}
+	return true
+}
+
+// admitSeries accounts a new series of a device, empty for series without
+// a device, false when it is rejected. The store calls it before creating
+// a series.
+func (l *Limits) admitSeries(device, topic string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if device != "" && l.quarantined(device, topic, now) {
+		return false
+	}
+	if l.conf.MaxSeries > 0 && l.series >= l.conf.MaxSeries {
+		if !l.warned {
+			l.warned = true
+			log.Printf("Warning: the exporter holds %d series, new series are rejected", l.series)
+		}
+		rejected.WithLabelValues(rejectSeriesLimit).Inc()
+		return false
+	}
+	l.warned = false
+	if device != "" {
+		q := l.device(device)
+		if l.conf.MaxSeriesPerDevice > 0 && q.series >= l.conf.MaxSeriesPerDevice {
+			l.quarantine[device] = &quarantine{Device: device, Reason: rejectDeviceSeriesLimit, Since: now, Topics: []string{}}
+			if l.conf.QuarantineSec > 0 {
+				until := now.Add(time.Duration(l.conf.QuarantineSec) * time.Second)
+				l.quarantine[device].Until = &until
+			}
+			quarantinedDevices.Set(float64(len(l.quarantine)))
+			log.Printf("Warning: device %s went past %d series on %s, quarantined", device, l.conf.MaxSeriesPerDevice, topic)
+			l.quarantined(device, topic, now)
+			return false
+		}
+		q.series++
+	}
+	l.series++
+	return true
+}
+
+// removedSeries accounts a series removed from the store.
+func (l *Limits) removedSeries(device string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.series--
+	if q := l.devices[device]; device != "" && q != nil {
+		if q.series--; q.series <= 0 && l.conf.MaxDeviceMessagesPerSec <= 0 {
+			delete(l.devices, device)
+		}
+	}
+}
+
+// prune drops the quotas of the devices without series whose bucket
+// refilled, a bucket holds a second of messages. The caller holds the lock.
+func (l *Limits) prune(now time.Time) {
+	l.pruned = now
+	for device, q := range l.devices {
+		if q.series <= 0 && now.Sub(q.bucket.last) >= time.Second {
+			delete(l.devices, device)
+		}
+	}
+}
+
+// quarantined reports whether a device is quarantined and accounts the
+// rejected topic, the caller holds the lock.
+func (l *Limits) quarantined(device, topic string, now time.Time) bool {
+	q := l.quarantine[device]
+	if q == nil {
+		return false
+	}
+	if q.Until != nil && now.After(*q.Until) {
+		l.release(device)
+		return false
+	}
+	q.Rejected++
+	if len(q.Topics) < maxOffendingTopics && !containsString(q.Topics, topic) {
+		q.Topics = append(q.Topics, topic)
+	}
+	rejected.WithLabelValues(rejectQuarantined).Inc()
+	return true
+}
+
+// release lifts the quarantine of a device, the caller holds the lock.
+func (l *Limits) release(device string) bool {
+	if _, ok := l.quarantine[device]; !ok {
+		return false
+	}
+	delete(l.quarantine, device)
+	quarantinedDevices.Set(float64(len(l.quarantine)))
+	log.Printf("Device %s released from quarantine", device)
+	return true
+}
+
+// Quarantined lists the quarantined devices.
+func (l *Limits) Quarantined() []quarantine {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := []quarantine{}
+	for device, q := range l.quarantine {
+		c := *q
+		c.Topics = append([]string{}, q.Topics...)
+		if d := l.devices[device]; d != nil {
+			c.Series = d.series
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Device < list[j].Device })
+	return list
+}
+
+const quarantinePrefix = "/api/v1/admin/quarantine"
+
+// ServeHTTP lists the quarantined devices on /api/v1/admin/quarantine and
+// releases one with DELETE /api/v1/admin/quarantine/{device}, ?purge=true
+// also removes its series so it starts again under its limit. Releasing
+// requires the admin token.
+func (l *Limits) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	device := strings.Trim(strings.TrimPrefix(r.URL.Path, quarantinePrefix), "/")
+	switch {
+	case device == "" && r.Method == http.MethodGet:
+		writeJSON(w, l.Quarantined())
+	case device != "" && r.Method == http.MethodGet:
+		for _, q := range l.Quarantined() {
+			if q.Device == device {
+				writeJSON(w, q)
+				return
+			}
+		}
+		http.Error(w, "device not quarantined", http.StatusNotFound)
+	case device != "" && r.Method == http.MethodDelete:
+		if !authorized(r, l.conf.AdminToken) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		l.mu.Lock()
+		released := l.release(device)
+		l.mu.Unlock()
+		if !released {
+			http.Error(w, "device not quarantined", http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("purge") == "true" {
+			metricStore.PurgeDevice(device)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/MOXA-ISD/edge-ha/pkg/remotewrite"
+	"github.com/MOXA-ISD/edge-ha/pkg/sparkplug"
 	"github.com/tidwall/gjson"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -14,42 +18,170 @@ import (
 )
 
 const (
-	appName     = "Mosquitto exporter"
-	bindAddress = "0.0.0.0:2112"
-	endpoint    = "tcp://127.0.0.1:1883"
+	appName = "Mosquitto exporter"
 )
 
 var (
-	counterKeyMetrics = map[string]string{
-		"devs/+/status": "The total number of bytes received since the broker started.",
-		"devs/+/tags/+": "The total number of bytes received since the broker started.",
+	configPath = flag.String("config", "/etc/mqtt-exporter/configuration.json", "path of the configuration file")
+	conf       Conf
+
+	defaultTopicMetrics = []*topicMetric{
+		{
+			Pattern: "devs/+/status",
+			Name:    "edge_device_status",
+			Help:    "Status reported by the device, 1 online and 0 offline.",
+			Type:    typeGauge,
+			Labels:  []string{"device"},
+		},
+		{
+			Pattern:       "devs/+/tags/+",
+			Name:          "edge_tag_value",
+			Help:          "Last value of a tag polled by the device.",
+			Type:          typeGauge,
+			Labels:        []string{"device", "tag"},
+			PayloadLabels: map[string]string{"src": "srcNmae"},
+		},
 	}
-	counterMetrics = map[string]*MosquittoCounter{}
-	jsonMetrics    = map[string]*prometheus.Desc{}
+	topicMetrics     []*topicMetric
+	metricStore      = newSeriesStore()
+	jsonMetrics      = map[string]*prometheus.Desc{}
+	sparkplugMetrics *SparkplugCollector
+	presenceTracker  *PresenceTracker
+	clockMonitor     *ClockMonitor
+	streamHub        *StreamHub
+	historian        *Historian
+	sinks            sinkSet
+	remoteWrite      *remotewrite.Client
+	deviceRegistry   *DeviceRegistry
+	relabeler        *Relabeler
+	exporterLimits   *Limits
 )
 
 func main() {
+	flag.Parse()
 	log.Printf("Starting mosquitto_broker")
+	var err error
+	path := configFile()
+	conf, err = loadConf(path)
+	fatalfOnError(err, "Failed to load configuration %s: %s", path, err)
+	subscriptions := map[string]byte{}
+	for _, sub := range conf.Mqtt.Subscriptions {
+		subscriptions[sub.Topic] = sub.Qos
+	}
+	topicMetrics = conf.Metrics
+	if conf.SysTopics && !conf.Broker.Enabled {
+		topicMetrics = append(topicMetrics, sysTopicMetrics()...)
+		if _, ok := subscriptions[sysPrefix+"#"]; !ok {
+			subscriptions[sysPrefix+"#"] = 0
+		}
+	}
+
+	if conf.Registry.Enabled {
+		deviceRegistry, err = NewDeviceRegistry(conf.Registry)
+		fatalfOnError(err, "Failed to load the device registry: %s", err)
+		prometheus.MustRegister(deviceRegistry)
+		go deviceRegistry.Run()
+	}
+	if conf.Limits.enabled() {
+		exporterLimits = NewLimits(conf.Limits)
+		prometheus.MustRegister(rejected, quarantinedDevices)
+	}
+	if len(conf.Relabel) > 0 {
+		relabeler = NewRelabeler(conf.Relabel)
+	}
+	presenceTracker = NewPresenceTracker(conf.Presence)
+	go presenceTracker.Run()
+	clockMonitor = NewClockMonitor(conf.Clock)
+	sparkplugMetrics = NewSparkplugCollector()
+	prometheus.MustRegister(sparkplugMetrics, presenceTracker, clockMonitor, arrivalDelay)
+	registerTopicMetrics()
+	registerStats(metricStore)
+	streamHub = NewStreamHub(conf.Stream, presenceTracker)
+	prometheus.MustRegister(streamClients, streamDropped)
+	if conf.Historian.Enabled {
+		historian, err = NewHistorian(conf.Historian)
+		fatalfOnError(err, "Failed to start the historian: %s", err)
+		go historian.Run()
+	}
+	sinks, err = newSinkSet(conf.Sinks)
+	fatalfOnError(err, "Failed to configure the sinks: %s", err)
+	sinks.Start()
+	prometheus.MustRegister(sinkSamples, sinkDropped, sinkRetries)
+	if conf.RemoteWrite.Enabled {
+		startRemoteWrite()
+	}
 
+	if conf.Broker.Enabled {
+		startEmbeddedBroker(subscriptions)
+	} else {
+		subscribeBroker(subscriptions)
+	}
+
+	go expireSeries(time.Duration(conf.Expiry.IntervalSec) * time.Second)
+
+	// init the router and server
+	http.Handle(conf.HTTP.MetricsPath, promhttp.Handler())
+	http.Handle("/presence/offline", presenceTracker)
+	api := &latestAPI{store: metricStore, presence: presenceTracker}
+	http.Handle(apiPrefix, api)
+	http.Handle(apiPrefix+"/", api)
+	http.Handle("/api/v1/stream/ws", streamHub.WebSocket())
+	http.HandleFunc("/api/v1/stream/sse", streamHub.ServeSSE)
+	if historian != nil {
+		http.Handle("/api/v1/history", historian)
+	}
+	if deviceRegistry != nil {
+		http.Handle(registryPrefix, deviceRegistry)
+		http.Handle(registryPrefix+"/", deviceRegistry)
+	}
+	if exporterLimits != nil {
+		http.Handle(quarantinePrefix, exporterLimits)
+		http.Handle(quarantinePrefix+"/", exporterLimits)
+	}
+	log.Printf("Listening on %s...", conf.HTTP.Addr)
+	err = http.ListenAndServe(conf.HTTP.Addr, nil)
+	fatalfOnError(err, "Failed to bind on %s: ", conf.HTTP.Addr)
+}
+
+// subscribeBroker connects to the external brokers, retrying forever, and
+// subscribes on every (re)connect.
+func subscribeBroker(subscriptions map[string]byte) {
+	endpoint := strings.Join(conf.Mqtt.Brokers, ",")
 	opts := mqtt.NewClientOptions()
 	opts.SetCleanSession(true)
-	opts.AddBroker(endpoint)
+	for _, broker := range conf.Mqtt.Brokers {
+		opts.AddBroker(broker)
+	}
+	opts.SetClientID(conf.Mqtt.ClientID)
+	opts.SetUsername(conf.Mqtt.Username)
+	opts.SetPassword(conf.Mqtt.Password)
+	tlsConfig, err := conf.Mqtt.TLS.tlsConfig()
+	fatalfOnError(err, "Failed to load tls configuration: %s", err)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
 
+	connected := false
 	opts.OnConnect = func(client mqtt.Client) {
 		log.Printf("Connected to %s", endpoint)
-		// subscribe on every (re)connect
-		token := client.Subscribe("#", 0, func(_ mqtt.Client, msg mqtt.Message) {
-			processUpdate(msg.Topic(), string(msg.Payload()))
+		if connected {
+			brokerReconnects.Inc()
+		}
+		connected = true
+		brokerConnected.Set(1)
+		token := client.SubscribeMultiple(subscriptions, func(_ mqtt.Client, msg mqtt.Message) {
+			handleMessage(msg.Topic(), msg.Payload())
 		})
 		if !token.WaitTimeout(10 * time.Second) {
-			log.Println("Error: Timeout subscribing to topic $SYS/#")
+			log.Printf("Error: Timeout subscribing to topics %v", subscriptions)
 		}
 		if err := token.Error(); err != nil {
-			log.Printf("Failed to subscribe to topic $SYS/#: %s", err)
+			log.Printf("Failed to subscribe to topics %v: %s", subscriptions, err)
 		}
 	}
 	opts.OnConnectionLost = func(client mqtt.Client, err error) {
 		log.Printf("Error: Connection to %s lost: %s", endpoint, err)
+		brokerConnected.Set(0)
 	}
 	client := mqtt.NewClient(opts)
 
@@ -66,12 +198,31 @@ func main() {
 		}
 		time.Sleep(5 * time.Second)
 	}
+}
 
-	// init the router and server
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Listening on %s...", bindAddress)
-	err := http.ListenAndServe(bindAddress, nil)
-	fatalfOnError(err, "Failed to bind on %s: ", bindAddress)
+// handleMessage routes a received message to the matching pipeline.
+func handleMessage(topic string, payload []byte) {
+	start := time.Now()
+	defer func() { processingDuration.Observe(time.Since(start).Seconds()) }()
+	if len(payload) == 0 {
+		// a cleared retained message, whatever pipeline fed the topic
+		metricStore.RemoveTopic(topic)
+		return
+	}
+	if exporterLimits != nil && !exporterLimits.AllowMessage() {
+		return
+	}
+	switch {
+	case strings.HasPrefix(topic, sparkplug.Namespace+"/"):
+		messagesReceived.WithLabelValues(sparkplug.Namespace + "/#").Inc()
+		sparkplugMetrics.Process(topic, payload)
+	case strings.HasPrefix(topic, sysPrefix):
+		// the broker publishes more statistics than we export
+		processTopicMetric(topic, string(payload))
+	case relabeler != nil && relabeler.Process(topic, string(payload)):
+	default:
+		processUpdate(topic, string(payload))
+	}
 }
 
 // $SYS/broker/bytes/received
@@ -80,49 +231,76 @@ func processUpdate(topic, payload string) {
 	arr := strings.Split(topic, "/")
 	if len(arr) < 3 {
 		log.Printf("invalid data %s:%s", topic, payload)
+		parseFailures.WithLabelValues(failInvalidTopic).Inc()
+		return
+	}
+	if exporterLimits != nil && !exporterLimits.AllowDevice(arr[1], topic) {
 		return
 	}
+	if deviceRegistry != nil {
+		deviceRegistry.Observe(arr[1])
+	}
 	switch arr[2] {
 	case "status":
+		v, reason := jsonNumber(gjson.Get(payload, "value"), nil)
+		if reason != "" {
+			// a garbage status says nothing about the device being up
+			log.Printf("invalid status from %s: %s", arr[1], payload)
+			parseFailures.WithLabelValues(reason).Inc()
+			break
+		}
+		presenceTracker.Status(arr[1], v != conf.Expiry.OfflineValue, gjson.Get(payload, "broker").String())
 	case "tags":
+		presenceTracker.Seen(arr[1])
+	case "batch":
+		presenceTracker.Seen(arr[1])
+		processBatch(arr[1], payload)
+		return
+	}
+	if !processTopicMetric(topic, payload) {
+		log.Printf("no metric for topic %s", topic)
+		unknownTopics.Inc()
 	}
-	processCounterMetric(topic, payload)
-}
 
-func processCounterMetric(topic, payload string) {
-	if counterMetrics[topic] != nil {
-		value := parseValue(payload)
-		counterMetrics[topic].Set(value)
-	} else {
-		// create a mosquitto counter pointer
-		mCounter := NewMosquittoCounter(prometheus.NewDesc(
-			parseTopic(topic),
-			topic,
-			[]string{},
-			prometheus.Labels{},
-		))
-
-		// save it
-		counterMetrics[topic] = mCounter
-		// register the metric
-		prometheus.MustRegister(mCounter)
-		// add the first value
-		value := parseValue(payload)
-		counterMetrics[topic].Set(value)
+	if values, ok := matchTopic(conf.Expiry.StatusTopic, topic); ok && len(values) == 1 {
+		// only a status that parsed can take the series of a device down
+		if v, reason := jsonNumber(gjson.Get(payload, "value"), nil); reason == "" && v == conf.Expiry.OfflineValue {
+			metricStore.RemoveDevice(values[0], topic)
+		}
 	}
 }
 
-func parseTopic(topic string) string {
-	name := strings.Replace(topic, "/", "_", -1)
-	name = strings.Replace(name, " ", "_", -1)
-	name = strings.Replace(name, "-", "_", -1)
-	name = strings.Replace(name, ".", "_", -1)
-	return name
+func expireSeries(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for now := range time.Tick(interval) {
+		metricStore.Expire(now)
+	}
 }
 
-func parseValue(payload string) float64 {
-	// fmt.Printf("Payload %s \n", payload)
-	return float64(gjson.Get(payload, "value").Int())
+// processBatch unpacks a devs/{id}/batch array into per tag updates.
+func processBatch(device, payload string) {
+	samples := gjson.Parse(payload)
+	if !samples.IsArray() {
+		log.Printf("invalid batch from %s: %s", device, payload)
+		parseFailures.WithLabelValues(failInvalidBatch).Inc()
+		return
+	}
+	samples.ForEach(func(_, sample gjson.Result) bool {
+		tag := sample.Get("tagNmae").String()
+		if tag == "" {
+			log.Printf("batch sample without tag from %s: %s", device, sample.Raw)
+			parseFailures.WithLabelValues(failInvalidBatch).Inc()
+			return true
+		}
+		tagTopic := fmt.Sprintf("devs/%s/tags/%s", device, tag)
+		if !processTopicMetric(tagTopic, sample.Raw) {
+			log.Printf("no metric for topic %s", tagTopic)
+			unknownTopics.Inc()
+		}
+		return true
+	})
 }
 
 func fatalfOnError(err error, msg string, args ...interface{}) {
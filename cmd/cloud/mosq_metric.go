@@ -0,0 +1,291 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+// Metric types of the topic mapping.
+const (
+	typeGauge    = "gauge"
+	typeCounter  = "counter"
+	typeInfo     = "info"
+	typeStateSet = "stateset"
+)
+
+// Payload formats of the topic mapping.
+const (
+	formatJSON = "json"
+	formatText = "text"
+)
+
+// deviceLabel identifies the series removed when a device goes offline.
+const deviceLabel = "device"
+
+var counterResets = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mqtt_exporter_counter_resets_total",
+	Help: "Number of times a counter value decreased.",
+}, []string{"metric"})
+
+// MosquittoMetric describes one metric family, its series live in the store
+type MosquittoMetric struct {
+	Desc *prometheus.Desc
+	Name string
+	// Labels are the labels of the series, without the value and state
+	// labels of info metrics and state sets
+	Labels []string
+	Type   string
+	States []string
+	TTL    time.Duration
+	Format string
+	states map[string]string
+	// valuePath is the gjson path of the value in json payloads
+	valuePath string
+	enum      map[string]float64
+	// timestamps exports the series with their source timestamp
+	timestamps bool
+	// textLabel is the label carrying the text of info metrics and state
+	// sets
+	textLabel string
+	// attributeLabels are the registry attributes joined onto the series,
+	// after the text label, registryIndex their position in the registry
+	// labels
+	attributeLabels []string
+	registryIndex   []int
+	// dynamic is set on the families created by the relabel rules
+	dynamic bool
+	// deviceIndex is the position of the "device" label, -1 without one
+	deviceIndex int
+}
+
+// NewMosquittoMetric get a new one, info metrics get an extra "value" label
+// and state sets a "state" label.
+func NewMosquittoMetric(m *topicMetric, labels []string) *MosquittoMetric {
+	labels = append([]string{}, labels...)
+	c := &MosquittoMetric{
+		Name:        m.Name,
+		Labels:      labels[:len(labels):len(labels)],
+		Type:        m.Type,
+		TTL:         m.ttl,
+		Format:      m.Format,
+		states:      m.States,
+		valuePath:   m.ValuePath,
+		enum:        m.Enum,
+		timestamps:  m.SourceTimestamp,
+		deviceIndex: -1,
+	}
+	if c.valuePath == "" {
+		c.valuePath = "value"
+	}
+	for i, l := range labels {
+		if l == deviceLabel {
+			c.deviceIndex = i
+		}
+	}
+	if c.Format != formatText {
+		c.Format = formatJSON
+	}
+	switch c.Type {
+	case typeInfo:
+		valueLabel := m.ValueLabel
+		if valueLabel == "" {
+			valueLabel = "value"
+		}
+		labels = append(labels, valueLabel)
+		c.textLabel = valueLabel
+	case typeStateSet:
+		labels = append(labels, "state")
+		c.textLabel = "state"
+		seen := map[string]bool{}
+		for _, state := range m.States {
+			if !seen[state] {
+				seen[state] = true
+				c.States = append(c.States, state)
+			}
+		}
+		sort.Strings(c.States)
+	case typeCounter:
+	default:
+		c.Type = typeGauge
+	}
+	if c.deviceIndex >= 0 && deviceRegistry != nil {
+		for i, l := range deviceRegistry.Labels() {
+			if !containsString(labels, l) {
+				labels = append(labels, l)
+				c.attributeLabels = append(c.attributeLabels, l)
+				c.registryIndex = append(c.registryIndex, i)
+			}
+		}
+	}
+	c.Desc = prometheus.NewDesc(m.Name, m.Help, labels, prometheus.Labels{})
+	return c
+}
+
+// parse reads the value of a payload, numbers for gauges and counters and
+// text for info and state sets. A payload that cannot be parsed is counted
+// as a failure and must not update the series.
+func (c *MosquittoMetric) parse(payload string) (float64, string, bool) {
+	raw := payload
+	if c.Format == formatJSON {
+		if !gjson.Valid(payload) {
+			return c.fail(failInvalidJSON, payload)
+		}
+		r := gjson.Get(payload, c.valuePath)
+		if !r.Exists() {
+			return c.fail(failMissingValue, payload)
+		}
+		raw = r.String()
+		if c.Type != typeInfo && c.Type != typeStateSet {
+			v, reason := jsonNumber(r, c.enum)
+			if reason != "" {
+				return c.fail(reason, payload)
+			}
+			return v, "", true
+		}
+	}
+	switch c.Type {
+	case typeInfo:
+		return 0, raw, true
+	case typeStateSet:
+		state, ok := c.states[raw]
+		if !ok {
+			return c.fail(failUnknownState, payload)
+		}
+		return 0, state, true
+	}
+	v, err := parseText(payload)
+	if err != nil {
+		return c.fail(failInvalidNumber, payload)
+	}
+	return v, "", true
+}
+
+func (c *MosquittoMetric) fail(reason, payload string) (float64, string, bool) {
+	log.Printf("%s: cannot parse %s: %s", c.Name, payload, reason)
+	parseFailures.WithLabelValues(reason).Inc()
+	return 0, "", false
+}
+
+// jsonNumber reads a json value as a number, booleans are 1 and 0 and
+// strings are looked up in enum before being parsed as numbers. It returns
+// the failure reason when the value is not a number.
+func jsonNumber(r gjson.Result, enum map[string]float64) (float64, string) {
+	switch r.Type {
+	case gjson.Number:
+		return r.Num, ""
+	case gjson.True:
+		return 1, ""
+	case gjson.False:
+		return 0, ""
+	case gjson.String:
+		if v, ok := enum[r.Str]; ok {
+			return v, ""
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(r.Str), 64)
+		if err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			// "NaN" and "Inf" parse but are no readings
+			return 0, failInvalidNumber
+		}
+		if err != nil {
+			if len(enum) > 0 {
+				return 0, failUnknownState
+			}
+			return 0, failInvalidNumber
+		}
+		return v, ""
+	}
+	if !r.Exists() {
+		return 0, failMissingValue
+	}
+	return 0, failInvalidType
+}
+
+// parseText reads the leading number of a plain payload like "3600 seconds".
+func parseText(payload string) (float64, error) {
+	fields := strings.Fields(payload)
+	if len(fields) == 0 {
+		return 0, strconv.ErrSyntax
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err == nil && (math.IsNaN(v) || math.IsInf(v, 0)) {
+		return 0, strconv.ErrSyntax
+	}
+	return v, err
+}
+
+// apply stores a parsed value, the caller holds the series lock.
+func (c *MosquittoMetric) apply(s *series, value float64, text string) {
+	if c.Type == typeCounter && value < s.value {
+		log.Printf("counter %s%v reset from %v to %v", c.Name, s.labelValues, s.value, value)
+		counterResets.WithLabelValues(c.Name).Inc()
+	}
+	s.value = value
+	s.text = text
+}
+
+// collect exports a series according to the metric type
+func (c *MosquittoMetric) collect(ch chan<- prometheus.Metric, s series) {
+	attrs := c.attributes(s.device)
+	emit := func(m prometheus.Metric) {
+		if c.timestamps && !s.timestamp.IsZero() {
+			m = prometheus.NewMetricWithTimestamp(s.timestamp, m)
+		}
+		ch <- m
+	}
+	switch c.Type {
+	case typeInfo:
+		emit(prometheus.MustNewConstMetric(c.Desc, prometheus.GaugeValue, 1, withLabel(s.labelValues, s.text, attrs...)...))
+	case typeStateSet:
+		for _, state := range c.States {
+			v := 0.0
+			if state == s.text {
+				v = 1
+			}
+			emit(prometheus.MustNewConstMetric(c.Desc, prometheus.GaugeValue, v, withLabel(s.labelValues, state, attrs...)...))
+		}
+	case typeCounter:
+		emit(prometheus.MustNewConstMetric(c.Desc, prometheus.CounterValue, s.value, withLabels(s.labelValues, attrs)...))
+	default:
+		emit(prometheus.MustNewConstMetric(c.Desc, prometheus.GaugeValue, s.value, withLabels(s.labelValues, attrs)...))
+	}
+}
+
+// attributes returns the values of the attribute labels for a device.
+func (c *MosquittoMetric) attributes(device string) []string {
+	if len(c.attributeLabels) == 0 {
+		return nil
+	}
+	values := deviceRegistry.Values(device)
+	attrs := make([]string, len(c.registryIndex))
+	for i, j := range c.registryIndex {
+		attrs[i] = values[j]
+	}
+	return attrs
+}
+
+func withLabel(labelValues []string, v string, extra ...string) []string {
+	return append(append(append(make([]string, 0, len(labelValues)+len(extra)+1), labelValues...), v), extra...)
+}
+
+func withLabels(labelValues, extra []string) []string {
+	if len(extra) == 0 {
+		return labelValues
+	}
+	return append(append(make([]string, 0, len(labelValues)+len(extra)), labelValues...), extra...)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
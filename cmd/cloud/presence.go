@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type presenceConf struct {
+	// TimeoutSec marks a device offline when nothing arrived from it for
+	// this long, 0 only trusts the status messages.
+	TimeoutSec int `json:"timeoutSec"`
+}
+
+type presence struct {
+	Device      string    `json:"device"`
+	Up          bool      `json:"up"`
+	LastSeen    time.Time `json:"lastSeen"`
+	OnlineSince time.Time `json:"onlineSince"`
+	OfflineAt   time.Time `json:"offlineSince"`
+	Flaps       int       `json:"flaps"`
+	// Broker is the broker the device reported being attached to.
+	Broker string `json:"broker,omitempty"`
+}
+
+// PresenceTracker derives whether devices are up from their status messages
+// and from data arrival.
+type PresenceTracker struct {
+	timeout time.Duration
+
+	upDesc          *prometheus.Desc
+	lastSeenDesc    *prometheus.Desc
+	onlineSinceDesc *prometheus.Desc
+	flapsDesc       *prometheus.Desc
+	offlineDesc     *prometheus.Desc
+	brokerDesc      *prometheus.Desc
+
+	mu      sync.RWMutex
+	devices map[string]*presence
+}
+
+// NewPresenceTracker get a new one
+func NewPresenceTracker(conf presenceConf) *PresenceTracker {
+	return &PresenceTracker{
+		timeout: time.Duration(conf.TimeoutSec) * time.Second,
+		upDesc: prometheus.NewDesc(
+			"edge_device_up",
+			"Whether the device is online.",
+			[]string{"device"},
+			nil,
+		),
+		lastSeenDesc: prometheus.NewDesc(
+			"edge_device_last_seen_timestamp_seconds",
+			"Last time a message arrived from the device.",
+			[]string{"device"},
+			nil,
+		),
+		onlineSinceDesc: prometheus.NewDesc(
+			"edge_device_online_since_timestamp_seconds",
+			"Time the device came online, only exported while it is up.",
+			[]string{"device"},
+			nil,
+		),
+		flapsDesc: prometheus.NewDesc(
+			"edge_device_flaps_total",
+			"Number of times the device changed between online and offline.",
+			[]string{"device"},
+			nil,
+		),
+		offlineDesc: prometheus.NewDesc(
+			"edge_devices_offline",
+			"Number of known devices currently offline.",
+			nil,
+			nil,
+		),
+		brokerDesc: prometheus.NewDesc(
+			"edge_device_broker_info",
+			"Broker the device reported being attached to.",
+			[]string{"device", "broker"},
+			nil,
+		),
+		devices: map[string]*presence{},
+	}
+}
+
+func (t *PresenceTracker) get(device string) *presence {
+	p := t.devices[device]
+	if p == nil {
+		p = &presence{Device: device}
+		t.devices[device] = p
+	}
+	return p
+}
+
+func (p *presence) set(up bool, now time.Time) {
+	if p.Up == up && !p.LastSeen.IsZero() {
+		return
+	}
+	if up {
+		p.OnlineSince = now
+	} else {
+		p.OfflineAt = now
+	}
+	if !p.LastSeen.IsZero() {
+		p.Flaps++
+	}
+	p.Up = up
+}
+
+// Status records an online/offline status message, broker is empty when the
+// device did not report it.
+func (t *PresenceTracker) Status(device string, up bool, broker string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	p := t.get(device)
+	if up {
+		p.set(true, now)
+	} else {
+		t.offline(p, now)
+	}
+	if broker != "" {
+		p.Broker = broker
+	}
+	p.LastSeen = now
+}
+
+// Seen records data arriving from a device, which proves it is online.
+func (t *PresenceTracker) Seen(device string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	p := t.get(device)
+	p.set(true, now)
+	p.LastSeen = now
+}
+
+// Run marks the silent devices offline, checking them a few times per
+// timeout.
+func (t *PresenceTracker) Run() {
+	if t.timeout <= 0 {
+		return
+	}
+	interval := t.timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for now := range time.Tick(interval) {
+		t.mu.Lock()
+		t.check(now)
+		t.mu.Unlock()
+	}
+}
+
+// check marks the silent devices offline, the caller holds the lock.
+func (t *PresenceTracker) check(now time.Time) {
+	if t.timeout <= 0 {
+		return
+	}
+	for _, p := range t.devices {
+		if p.Up && now.Sub(p.LastSeen) > t.timeout {
+			t.offline(p, now)
+		}
+	}
+}
+
+// offline marks a device offline and drops the clock state it no longer
+// updates, the caller holds the lock.
+func (t *PresenceTracker) offline(p *presence, now time.Time) {
+	p.set(false, now)
+	if clockMonitor != nil {
+		clockMonitor.Forget(p.Device)
+	}
+}
+
+// Get returns the presence of a device.
+func (t *PresenceTracker) Get(device string) (presence, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	p, ok := t.devices[device]
+	if !ok {
+		return presence{}, false
+	}
+	return *p, true
+}
+
+// Offline lists the devices currently offline.
+func (t *PresenceTracker) Offline() []presence {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	offline := []presence{}
+	for _, p := range t.devices {
+		if !p.Up {
+			offline = append(offline, *p)
+		}
+	}
+	sort.Slice(offline, func(i, j int) bool { return offline[i].Device < offline[j].Device })
+	return offline
+}
+
+// ServeHTTP answers the list of offline devices.
+func (t *PresenceTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.Offline())
+}
+
+// Describe sends the descriptors of the presence metrics.
+func (t *PresenceTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.upDesc
+	ch <- t.lastSeenDesc
+	ch <- t.onlineSinceDesc
+	ch <- t.flapsDesc
+	ch <- t.offlineDesc
+	ch <- t.brokerDesc
+}
+
+// Collect exports the presence of every device.
+func (t *PresenceTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	offline := 0
+	for device, p := range t.devices {
+		ch <- prometheus.MustNewConstMetric(t.upDesc, prometheus.GaugeValue, boolValue(p.Up), device)
+		ch <- prometheus.MustNewConstMetric(t.lastSeenDesc, prometheus.GaugeValue, unixSeconds(p.LastSeen), device)
+		ch <- prometheus.MustNewConstMetric(t.flapsDesc, prometheus.CounterValue, float64(p.Flaps), device)
+		if p.Broker != "" {
+			ch <- prometheus.MustNewConstMetric(t.brokerDesc, prometheus.GaugeValue, 1, device, p.Broker)
+		}
+		if p.Up {
+			ch <- prometheus.MustNewConstMetric(t.onlineSinceDesc, prometheus.GaugeValue, unixSeconds(p.OnlineSince), device)
+		} else {
+			offline++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(t.offlineDesc, prometheus.GaugeValue, float64(offline))
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
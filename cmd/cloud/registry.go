@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var defaultRegistryLabels = []string{"site", "area", "line", "model", "owner"}
+
+type registryConf struct {
+	Enabled bool `json:"enabled"`
+	// Path of the JSON file mapping the client id of every device onto its
+	// attributes, e.g. {"gw-01": {"site": "tpe", "line": "3"}}.
+	Path string `json:"path"`
+	// Labels are the attributes joined onto the metrics of a device, site,
+	// area, line, model and owner by default.
+	Labels []string `json:"labels"`
+	// ReloadIntervalSec is how often the file is checked for changes.
+	ReloadIntervalSec int `json:"reloadIntervalSec"`
+	// AdminToken is the bearer token editing devices through the API, the
+	// registry can only be read without it.
+	AdminToken string `json:"adminToken"`
+}
+
+// DeviceRegistry holds the attributes of the known devices, loaded from a
+// file that is reloaded when it changes and rewritten when the devices are
+// edited through the API.
+type DeviceRegistry struct {
+	conf registryConf
+
+	infoDesc    *prometheus.Desc
+	unknownDesc *prometheus.Desc
+
+	mu      sync.RWMutex
+	devices map[string]map[string]string
+	modTime time.Time
+	// unknown are the devices seen without being registered, each is
+	// warned about once
+	unknown map[string]bool
+}
+
+// NewDeviceRegistry loads the registry file, a missing file is an empty
+// registry.
+func NewDeviceRegistry(conf registryConf) (*DeviceRegistry, error) {
+	if len(conf.Labels) == 0 {
+		conf.Labels = defaultRegistryLabels
+	}
+	seen := map[string]bool{}
+	for _, l := range conf.Labels {
+		if !labelNameRE.MatchString(l) || strings.HasPrefix(l, "__") || l == deviceLabel {
+			return nil, fmt.Errorf("invalid registry label %q", l)
+		}
+		if seen[l] {
+			return nil, fmt.Errorf("duplicate registry label %q", l)
+		}
+		seen[l] = true
+	}
+	if conf.ReloadIntervalSec <= 0 {
+		conf.ReloadIntervalSec = 30
+	}
+	r := &DeviceRegistry{
+		conf: conf,
+		infoDesc: prometheus.NewDesc(
+			"edge_device_info",
+			"Attributes of the registered devices.",
+			append([]string{deviceLabel}, conf.Labels...),
+			nil,
+		),
+		unknownDesc: prometheus.NewDesc(
+			"edge_devices_unregistered",
+			"Number of devices seen without being registered.",
+			nil,
+			nil,
+		),
+		devices: map[string]map[string]string{},
+		unknown: map[string]bool{},
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Labels are the names of the attributes joined onto the metrics.
+func (r *DeviceRegistry) Labels() []string {
+	return r.conf.Labels
+}
+
+// Values returns the attributes of a device in the order of Labels, empty
+// for an unknown device.
+func (r *DeviceRegistry) Values(device string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	attrs := r.devices[device]
+	values := make([]string, len(r.conf.Labels))
+	for i, l := range r.conf.Labels {
+		values[i] = attrs[l]
+	}
+	return values
+}
+
+// Observe warns the first time a device that is not registered sends data.
+func (r *DeviceRegistry) Observe(device string) {
+	r.mu.RLock()
+	_, known := r.devices[device]
+	warned := r.unknown[device]
+	r.mu.RUnlock()
+	if known || warned {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.devices[device]; ok || r.unknown[device] {
+		return
+	}
+	r.unknown[device] = true
+	log.Printf("Warning: device %s is not in the registry", device)
+}
+
+// Run reloads the registry file whenever it changes.
+func (r *DeviceRegistry) Run() {
+	if r.conf.Path == "" {
+		return
+	}
+	for range time.Tick(time.Duration(r.conf.ReloadIntervalSec) * time.Second) {
+		if err := r.load(); err != nil {
+			log.Printf("Failed to reload the device registry: %s", err)
+		}
+	}
+}
+
+// load reads the registry file if it changed since it was last read.
+func (r *DeviceRegistry) load() error {
+	if r.conf.Path == "" {
+		return nil
+	}
+	info, err := os.Stat(r.conf.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.mu.RLock()
+	unchanged := info.ModTime().Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.conf.Path)
+	if err != nil {
+		return err
+	}
+	devices := map[string]map[string]string{}
+	if err := json.Unmarshal(data, &devices); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.devices = devices
+	r.modTime = info.ModTime()
+	for device := range devices {
+		delete(r.unknown, device)
+	}
+	log.Printf("Loaded %d devices from the registry %s", len(devices), r.conf.Path)
+	return nil
+}
+
+// save rewrites the registry file with the edited devices, the caller holds
+// the lock and swaps them in once saved.
+func (r *DeviceRegistry) save(devices map[string]map[string]string) error {
+	if r.conf.Path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(devices, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(r.conf.Path), "."+filepath.Base(r.conf.Path)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, r.conf.Path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if info, err := os.Stat(r.conf.Path); err == nil {
+		r.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// copyDevices returns a copy of the devices to edit, the caller holds the
+// lock.
+func (r *DeviceRegistry) copyDevices() map[string]map[string]string {
+	devices := make(map[string]map[string]string, len(r.devices)+1)
+	for device, attrs := range r.devices {
+		devices[device] = attrs
+	}
+	return devices
+}
+
+const registryPrefix = "/api/v1/registry"
+
+// ServeHTTP lists the devices on /api/v1/registry, and reads, replaces or
+// deletes the attributes of a device on /api/v1/registry/{device}, the
+// edits require the admin token.
+func (r *DeviceRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	device := strings.Trim(strings.TrimPrefix(req.URL.Path, registryPrefix), "/")
+	if device == "" {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		writeJSON(w, r.devices)
+		return
+	}
+	if strings.Contains(device, "/") {
+		http.NotFound(w, req)
+		return
+	}
+
+	if req.Method != http.MethodGet && !authorized(req, r.conf.AdminToken) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		r.mu.RLock()
+		attrs, ok := r.devices[device]
+		r.mu.RUnlock()
+		if !ok {
+			http.Error(w, "unknown device", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, attrs)
+	case http.MethodPut:
+		attrs := map[string]string{}
+		if err := json.NewDecoder(req.Body).Decode(&attrs); err != nil {
+			http.Error(w, "invalid attributes: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		devices := r.copyDevices()
+		devices[device] = attrs
+		if err := r.save(devices); err != nil {
+			http.Error(w, "failed to save the registry: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.devices = devices
+		delete(r.unknown, device)
+		writeJSON(w, attrs)
+	case http.MethodDelete:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if _, ok := r.devices[device]; !ok {
+			http.Error(w, "unknown device", http.StatusNotFound)
+			return
+		}
+		devices := r.copyDevices()
+		delete(devices, device)
+		if err := r.save(devices); err != nil {
+			http.Error(w, "failed to save the registry: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.devices = devices
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Describe sends the descriptors of the registry metrics.
+func (r *DeviceRegistry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.infoDesc
+	ch <- r.unknownDesc
+}
+
+// Collect exports the attributes of every registered device.
+func (r *DeviceRegistry) Collect(ch chan<- prometheus.Metric) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	devices := make([]string, 0, len(r.devices))
+	for device := range r.devices {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		values := []string{device}
+		for _, l := range r.conf.Labels {
+			values = append(values, r.devices[device][l])
+		}
+		ch <- prometheus.MustNewConstMetric(r.infoDesc, prometheus.GaugeValue, 1, values...)
+	}
+	ch <- prometheus.MustNewConstMetric(r.unknownDesc, prometheus.GaugeValue, float64(len(r.unknown)))
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Actions of a relabel rule.
+const (
+	relabelReplace = "replace"
+	relabelKeep    = "keep"
+	relabelDrop    = "drop"
+)
+
+var (
+	labelNameRE   = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	invalidNameRE = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+)
+
+// relabelRule rewrites incoming topics into metrics, in the spirit of the
+// Prometheus relabel configs. The rules apply in order: keep drops the
+// messages whose topic does not match, drop the ones whose topic matches,
+// and replace sets the metric name and labels from the capture groups of
+// the topic. A message left with a metric name is ingested as that metric,
+// the others go through the built-in devs/{id}/... handling.
+type relabelRule struct {
+	// Regex is matched against the whole topic, e.g.
+	// "([^/]+)/([^/]+)/([^/]+)/(?P<tag>[^/]+)".
+	Regex string `json:"regex"`
+	// Action is replace, keep or drop, replace by default.
+	Action string `json:"action"`
+	// Name is the template of the metric name, "$1" and "${tag}" expand
+	// to the capture groups. Characters not allowed in metric names are
+	// replaced by "_".
+	Name string `json:"name"`
+	// Labels maps label names onto templates of their value.
+	Labels map[string]string `json:"labels"`
+
+	// Help, Type, ValuePath, Enum, Format and TTL describe the metric as
+	// for the topic metrics, the last matching rule setting them wins.
+	Help      string             `json:"help"`
+	Type      string             `json:"type"`
+	ValuePath string             `json:"valuePath"`
+	Enum      map[string]float64 `json:"enum"`
+	Format    string             `json:"format"`
+	TTL       string             `json:"ttl"`
+
+	re  *regexp.Regexp
+	ttl time.Duration
+}
+
+func (r *relabelRule) compile() error {
+	if r.Regex == "" {
+		r.Regex = "(.*)"
+	}
+	re, err := regexp.Compile("^(?:" + r.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex: %s", err)
+	}
+	r.re = re
+	switch r.Action {
+	case "":
+		r.Action = relabelReplace
+	case relabelReplace, relabelKeep, relabelDrop:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	switch r.Type {
+	case "", typeGauge, typeCounter, typeInfo:
+	default:
+		return fmt.Errorf("type %q is not supported, use gauge, counter or info", r.Type)
+	}
+	for l := range r.Labels {
+		if !labelNameRE.MatchString(l) || strings.HasPrefix(l, "__") {
+			return fmt.Errorf("invalid label name %q", l)
+		}
+	}
+	if r.TTL != "" {
+		if r.ttl, err = time.ParseDuration(r.TTL); err != nil {
+			return fmt.Errorf("invalid ttl: %s", err)
+		}
+	}
+	return nil
+}
+
+// relabeledMetric is the outcome of the rules for a topic.
+type relabeledMetric struct {
+	topicMetric
+	labels map[string]string
+	// rule is the regex of the last rule that matched
+	rule string
+}
+
+// Relabeler applies the relabel rules to the incoming topics and keeps the
+// metric families they create.
+type Relabeler struct {
+	rules []*relabelRule
+
+	mu       sync.Mutex
+	families map[string]*MosquittoMetric
+	// conflicts are the metric names already warned about
+	conflicts map[string]bool
+}
+
+// NewRelabeler get a new one
+func NewRelabeler(rules []*relabelRule) *Relabeler {
+	return &Relabeler{
+		rules:     rules,
+		families:  map[string]*MosquittoMetric{},
+		conflicts: map[string]bool{},
+	}
+}
+
+// Process ingests a message according to the rules, it returns false when
+// no rule named a metric for the topic and the message is still to be
+// handled.
+func (r *Relabeler) Process(topic, payload string) bool {
+	m, keep := r.apply(topic)
+	if !keep {
+		relabelDropped.Inc()
+		return true
+	}
+	if m == nil {
+		return false
+	}
+	messagesReceived.WithLabelValues(m.rule).Inc()
+
+	names := make([]string, 0, len(m.labels))
+	for l := range m.labels {
+		names = append(names, l)
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	for i, l := range names {
+		values[i] = m.labels[l]
+	}
+	if device, ok := m.labels[deviceLabel]; ok && exporterLimits != nil && !exporterLimits.AllowDevice(device, topic) {
+		return true
+	}
+	family, created, ok := r.family(&m.topicMetric, names)
+	if !ok {
+		parseFailures.WithLabelValues(failLabelConflict).Inc()
+		return true
+	}
+	if family.deviceIndex >= 0 {
+		device := values[family.deviceIndex]
+		presenceTracker.Seen(device)
+		if deviceRegistry != nil {
+			deviceRegistry.Observe(device)
+		}
+	}
+	var ts time.Time
+	if family.Format != formatText {
+		if t, ok := sourceTime(payload, "timestamp"); ok {
+			ts = t
+			if family.deviceIndex >= 0 && clockMonitor != nil {
+				clockMonitor.Observe(values[family.deviceIndex], ts, time.Now())
+			}
+		}
+	}
+	if !ingest(family, topic, values, payload, ts) && created {
+		// a family is only kept once it holds a series, rejected series
+		// must not grow the families
+		r.forget(family)
+	}
+	return true
+}
+
+// apply runs the rules over a topic, it returns the metric they describe,
+// nil without a name, and false when the message is dropped.
+func (r *Relabeler) apply(topic string) (*relabeledMetric, bool) {
+	var m *relabeledMetric
+	for _, rule := range r.rules {
+		match := rule.re.FindStringSubmatchIndex(topic)
+		switch rule.Action {
+		case relabelKeep:
+			if match == nil {
+				return nil, false
+			}
+			continue
+		case relabelDrop:
+			if match != nil {
+				return nil, false
+			}
+			continue
+		}
+		if match == nil {
+			continue
+		}
+		if m == nil {
+			m = &relabeledMetric{labels: map[string]string{}}
+		}
+		expand := func(template string) string {
+			return string(rule.re.ExpandString(nil, template, topic, match))
+		}
+		if rule.Name != "" {
+			m.Name = invalidNameRE.ReplaceAllString(expand(rule.Name), "_")
+		}
+		for l, template := range rule.Labels {
+			m.labels[l] = expand(template)
+		}
+		if rule.Help != "" {
+			m.Help = rule.Help
+		}
+		if rule.Type != "" {
+			m.Type = rule.Type
+		}
+		if rule.ValuePath != "" {
+			m.ValuePath = rule.ValuePath
+		}
+		if rule.Enum != nil {
+			m.Enum = rule.Enum
+		}
+		if rule.Format != "" {
+			m.Format = rule.Format
+		}
+		if rule.ttl > 0 {
+			m.ttl = rule.ttl
+		}
+		m.rule = rule.Regex
+	}
+	if m == nil || m.Name == "" {
+		return nil, true
+	}
+	if m.Name[0] >= '0' && m.Name[0] <= '9' {
+		m.Name = "_" + m.Name
+	}
+	if m.Help == "" {
+		m.Help = "Relabeled from the mqtt topic."
+	}
+	return m, true
+}
+
+// family returns the family of a metric name, created on first use. A name
+// keeps the labels it was created with, and cannot take the name of a metric
+// the exporter already exports, the message is rejected otherwise.
+func (r *Relabeler) family(m *topicMetric, labels []string) (*MosquittoMetric, bool, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	family, ok := r.families[m.Name]
+	if !ok {
+		if m.Type == typeInfo && containsString(labels, "value") {
+			r.conflict(m.Name, `is an info metric, its value is the "value" label`)
+			return nil, false, false
+		}
+		family = NewMosquittoMetric(m, labels)
+		if registeredName(family.Desc) {
+			r.conflict(m.Name, "is already exported")
+			return nil, false, false
+		}
+		family.dynamic = true
+		r.families[m.Name] = family
+		return family, true, true
+	}
+	if strings.Join(family.Labels, ",") != strings.Join(labels, ",") {
+		r.conflict(m.Name, fmt.Sprintf("has labels %v, not %v", family.Labels, labels))
+		return nil, false, false
+	}
+	return family, false, true
+}
+
+func (r *Relabeler) forget(family *MosquittoMetric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.families[family.Name] == family {
+		delete(r.families, family.Name)
+	}
+}
+
+func (r *Relabeler) conflict(name, reason string) {
+	if !r.conflicts[name] {
+		r.conflicts[name] = true
+		log.Printf("Warning: relabeled metric %s %s, messages dropped", name, reason)
+	}
+}
+
+// descProbe describes a single metric and collects nothing.
+type descProbe struct {
+	desc *prometheus.Desc
+}
+
+func (p descProbe) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.desc
+}
+
+func (p descProbe) Collect(chan<- prometheus.Metric) {}
+
+// registeredName reports whether a registered collector describes a metric
+// of the name of desc: the registry refuses a second collector describing
+// it.
+func registeredName(desc *prometheus.Desc) bool {
+	probe := descProbe{desc}
+	if err := prometheus.Register(probe); err != nil {
+		return true
+	}
+	prometheus.Unregister(probe)
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/MOXA-ISD/edge-ha/pkg/remotewrite"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type remoteWriteConf struct {
+	Enabled bool `json:"enabled"`
+	remotewrite.Config
+}
+
+// startRemoteWrite runs the remote_write client every ingested sample is
+// pushed to.
+func startRemoteWrite() {
+	c, err := remotewrite.New(conf.RemoteWrite.Config)
+	fatalfOnError(err, "Failed to configure remote write: %s", err)
+	c.Start()
+	remoteWrite = c
+	prometheus.MustRegister(newRemoteWriteCollector(c))
+}
+
+// remoteWriteSeries converts an updated series into remote_write series
+// stamped with the source timestamp, or the arrival time without one. Info
+// metrics and state sets are converted as they are exported, with their
+// text in a label.
+func remoteWriteSeries(ss series) []remotewrite.TimeSeries {
+	family := ss.family
+	t := ss.timestamp
+	if t.IsZero() {
+		t = ss.updated
+	}
+	ts := t.UnixNano() / 1e6
+	newSeries := func(value float64, extra ...remotewrite.Label) remotewrite.TimeSeries {
+		labels := make([]remotewrite.Label, 0, len(family.Labels)+len(extra)+1)
+		labels = append(labels, remotewrite.Label{Name: "__name__", Value: family.Name})
+		for i, l := range family.Labels {
+			labels = append(labels, remotewrite.Label{Name: l, Value: ss.labelValues[i]})
+		}
+		for i, v := range family.attributes(ss.device) {
+			if v != "" {
+				labels = append(labels, remotewrite.Label{Name: family.attributeLabels[i], Value: v})
+			}
+		}
+		return remotewrite.TimeSeries{
+			Labels:  append(labels, extra...),
+			Samples: []remotewrite.Sample{{Value: value, Timestamp: ts}},
+		}
+	}
+
+	switch family.Type {
+	case typeInfo:
+		return []remotewrite.TimeSeries{newSeries(1, remotewrite.Label{Name: family.textLabel, Value: ss.text})}
+	case typeStateSet:
+		out := make([]remotewrite.TimeSeries, 0, len(family.States))
+		for _, state := range family.States {
+			v := 0.0
+			if state == ss.text {
+				v = 1
+			}
+			out = append(out, newSeries(v, remotewrite.Label{Name: family.textLabel, Value: state}))
+		}
+		return out
+	default:
+		return []remotewrite.TimeSeries{newSeries(ss.value)}
+	}
+}
+
+// remoteWriteCollector exports the remote_write client statistics.
+type remoteWriteCollector struct {
+	client *remotewrite.Client
+
+	sent     *prometheus.Desc
+	dropped  *prometheus.Desc
+	spilled  *prometheus.Desc
+	retries  *prometheus.Desc
+	pending  *prometheus.Desc
+	walBytes *prometheus.Desc
+}
+
+func newRemoteWriteCollector(c *remotewrite.Client) *remoteWriteCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(name, help, nil, nil)
+	}
+	return &remoteWriteCollector{
+		client:   c,
+		sent:     desc("mqtt_exporter_remote_write_samples_sent_total", "Number of samples sent to the remote_write endpoint."),
+		dropped:  desc("mqtt_exporter_remote_write_samples_dropped_total", "Number of samples dropped by remote write."),
+		spilled:  desc("mqtt_exporter_remote_write_samples_spilled_total", "Number of samples spilled to the remote write wal."),
+		retries:  desc("mqtt_exporter_remote_write_retries_total", "Number of retried remote write requests."),
+		pending:  desc("mqtt_exporter_remote_write_pending_samples", "Number of samples queued in memory for remote write."),
+		walBytes: desc("mqtt_exporter_remote_write_wal_bytes", "Size of the remote write wal."),
+	}
+}
+
+// Describe sends the descriptors of the remote write metrics.
+func (c *remoteWriteCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sent
+	ch <- c.dropped
+	ch <- c.spilled
+	ch <- c.retries
+	ch <- c.pending
+	ch <- c.walBytes
+}
+
+// Collect exports the current remote write statistics.
+func (c *remoteWriteCollector) Collect(ch chan<- prometheus.Metric) {
+	st := c.client.Stats()
+	ch <- prometheus.MustNewConstMetric(c.sent, prometheus.CounterValue, float64(st.SamplesSent))
+	ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(st.SamplesDropped))
+	ch <- prometheus.MustNewConstMetric(c.spilled, prometheus.CounterValue, float64(st.SamplesSpilled))
+	ch <- prometheus.MustNewConstMetric(c.retries, prometheus.CounterValue, float64(st.Retries))
+	ch <- prometheus.MustNewConstMetric(c.pending, prometheus.GaugeValue, float64(st.Pending))
+	ch <- prometheus.MustNewConstMetric(c.walBytes, prometheus.GaugeValue, float64(st.WALBytes))
+}
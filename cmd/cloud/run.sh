@@ -1,4 +1,7 @@
 #!/bin/sh
 
-service mosquitto start
-/usr/sbin/mqtt-exporter
\ No newline at end of file
+# the exporter serves mqtt itself with MQTT_EXPORTER_EMBEDDED_BROKER=true
+if [ "$MQTT_EXPORTER_EMBEDDED_BROKER" != "true" ]; then
+    service mosquitto start
+fi
+/usr/sbin/mqtt-exporter
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// postBatch sends a request body, a client error other than 429 is
+// permanent.
+func postBatch(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// influxWriter writes the samples in the line protocol, to the 2.x API
+// when a bucket is configured and to the 1.x one otherwise.
+type influxWriter struct {
+	conf   sinkConf
+	client *http.Client
+	url    string
+}
+
+func newInfluxWriter(conf sinkConf) (*influxWriter, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", conf.URL)
+	}
+	params := url.Values{"precision": {"ns"}}
+	if conf.Bucket != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		params.Set("org", conf.Org)
+		params.Set("bucket", conf.Bucket)
+	} else {
+		if conf.Database == "" {
+			return nil, fmt.Errorf("database or bucket is required")
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		params.Set("db", conf.Database)
+		if conf.RetentionPolicy != "" {
+			params.Set("rp", conf.RetentionPolicy)
+		}
+	}
+	u.RawQuery = params.Encode()
+	return &influxWriter{
+		conf:   conf,
+		client: &http.Client{Timeout: time.Duration(conf.TimeoutSec) * time.Second},
+		url:    u.String(),
+	}, nil
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	fieldEscaper       = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// line formats a sample in the line protocol, false for values InfluxDB
+// cannot store.
+func (w *influxWriter) line(buf *bytes.Buffer, s sinkSample) bool {
+	if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+		return false
+	}
+	measurement := w.conf.Measurement
+	if measurement == "" {
+		measurement = s.Metric
+	}
+	buf.WriteString(measurementEscaper.Replace(measurement))
+	labels := make([]string, 0, len(s.Labels))
+	for l := range s.Labels {
+		labels = append(labels, l)
+	}
+	if w.conf.Measurement != "" {
+		labels = append(labels, "metric")
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		v := s.Labels[l]
+		if l == "metric" && w.conf.Measurement != "" {
+			v = s.Metric
+		}
+		if v != "" {
+			fmt.Fprintf(buf, ",%s=%s", tagEscaper.Replace(l), tagEscaper.Replace(v))
+		}
+	}
+	fmt.Fprintf(buf, " value=%s", strconv.FormatFloat(s.Value, 'g', -1, 64))
+	if s.Text != "" {
+		fmt.Fprintf(buf, `,text="%s"`, fieldEscaper.Replace(s.Text))
+	}
+	fmt.Fprintf(buf, " %d\n", s.Time().UnixNano())
+	return true
+}
+
+func (w *influxWriter) Write(batch []sinkSample) error {
+	var buf bytes.Buffer
+	for _, s := range batch {
+		w.line(&buf, s)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, &buf)
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case w.conf.Token != "":
+		req.Header.Set("Authorization", "Token "+w.conf.Token)
+	case w.conf.Username != "":
+		req.SetBasicAuth(w.conf.Username, w.conf.Password)
+	}
+	return postBatch(w.client, req)
+}
+
+// httpWriter posts every batch as a json array.
+type httpWriter struct {
+	conf   sinkConf
+	client *http.Client
+}
+
+func newHTTPWriter(conf sinkConf) (*httpWriter, error) {
+	if u, err := url.Parse(conf.URL); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", conf.URL)
+	}
+	return &httpWriter{
+		conf:   conf,
+		client: &http.Client{Timeout: time.Duration(conf.TimeoutSec) * time.Second},
+	}, nil
+}
+
+func (w *httpWriter) Write(batch []sinkSample) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return permanentError{err}
+	}
+	req, err := http.NewRequest(http.MethodPost, w.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	return postBatch(w.client, req)
+}
+
+// fileWriter appends the samples as JSON lines, rotating the file once it
+// reaches the maximum size.
+type fileWriter struct {
+	conf    sinkConf
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+func newFileWriter(conf sinkConf) (*fileWriter, error) {
+	if conf.Path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	if conf.MaxSizeMB <= 0 {
+		conf.MaxSizeMB = 100
+	}
+	if conf.MaxFiles <= 0 {
+		conf.MaxFiles = 5
+	}
+	if err := os.MkdirAll(filepath.Dir(conf.Path), 0755); err != nil {
+		return nil, err
+	}
+	w := &fileWriter{conf: conf, maxSize: int64(conf.MaxSizeMB) << 20}
+	return w, w.open()
+}
+
+func (w *fileWriter) open() error {
+	f, err := os.OpenFile(w.conf.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size = f, info.Size()
+	return nil
+}
+
+// rotate shifts path.N-1 to path.N down to path to path.1.
+func (w *fileWriter) rotate() error {
+	w.file.Close()
+	w.file = nil
+	for i := w.conf.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.conf.Path, i), fmt.Sprintf("%s.%d", w.conf.Path, i+1))
+	}
+	if err := os.Rename(w.conf.Path, w.conf.Path+".1"); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *fileWriter) Write(batch []sinkSample) error {
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range batch {
+		mark := buf.Len()
+		if err := enc.Encode(s); err != nil {
+			buf.Truncate(mark)
+			sinkDropped.WithLabelValues(w.conf.Name, dropInvalidValue).Inc()
+		}
+	}
+	n, err := w.file.Write(buf.Bytes())
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if w.size >= w.maxSize {
+		// the batch is written, a failed rotation is retried on the next one
+		if err := w.rotate(); err != nil {
+			log.Printf("Sink %s failed to rotate %s: %s", w.conf.Name, w.conf.Path, err)
+		}
+	}
+	return nil
+}
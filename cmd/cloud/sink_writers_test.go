@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func testSamples() []sinkSample {
+	ts := time.Unix(1500000000, 0)
+	return []sinkSample{
+		{Topic: "devs/gw-01/temp", latestValue: latestValue{
+			Device: "gw-01", Metric: "temp", Value: 21.5, Updated: ts,
+			Labels: map[string]string{"device": "gw-01", "site": "tpe 1"},
+		}},
+		{Topic: "devs/gw-01/mode", latestValue: latestValue{
+			Device: "gw-01", Metric: "mode", Value: 1, Text: `a "b"`, Updated: ts,
+			Labels: map[string]string{"device": "gw-01"},
+		}},
+	}
+}
+
+// recorder is a test server answering with the queued status codes, 204
+// once they are exhausted.
+type recorder struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, string(body))
+	status := http.StatusNoContent
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func TestInfluxWriter(t *testing.T) {
+	rec := &recorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	w, err := newInfluxWriter(sinkConf{URL: srv.URL, Database: "edge", RetentionPolicy: "week", Username: "u", Password: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(testSamples()); err != nil {
+		t.Fatal(err)
+	}
+	req := rec.requests[0]
+	if req.URL.Path != "/write" || req.URL.Query().Get("db") != "edge" || req.URL.Query().Get("rp") != "week" {
+		t.Errorf("1.x request on %s", req.URL)
+	}
+	if user, pass, ok := req.BasicAuth(); !ok || user != "u" || pass != "p" {
+		t.Errorf("basic auth %q %q", user, pass)
+	}
+	want := "temp,device=gw-01,site=tpe\\ 1 value=21.5 1500000000000000000\n" +
+		"mode,device=gw-01 value=1,text=\"a \\\"b\\\"\" 1500000000000000000\n"
+	if rec.bodies[0] != want {
+		t.Errorf("body\n%s\nwant\n%s", rec.bodies[0], want)
+	}
+
+	w, err = newInfluxWriter(sinkConf{URL: srv.URL + "/influx/", Org: "moxa", Bucket: "edge", Token: "secret", Measurement: "edge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(testSamples()[:1]); err != nil {
+		t.Fatal(err)
+	}
+	req = rec.requests[1]
+	if req.URL.Path != "/influx/api/v2/write" || req.URL.Query().Get("org") != "moxa" || req.URL.Query().Get("bucket") != "edge" {
+		t.Errorf("2.x request on %s", req.URL)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "Token secret" {
+		t.Errorf("authorization %q", auth)
+	}
+	if !strings.HasPrefix(rec.bodies[1], "edge,device=gw-01,metric=temp,site=tpe\\ 1 ") {
+		t.Errorf("body %s", rec.bodies[1])
+	}
+
+	if _, err := newInfluxWriter(sinkConf{URL: srv.URL}); err == nil {
+		t.Error("no error without database nor bucket")
+	}
+}
+
+func TestHTTPWriter(t *testing.T) {
+	rec := &recorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	w, err := newHTTPWriter(sinkConf{URL: srv.URL + "/hook", Headers: map[string]string{"X-Api-Key": "k"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(testSamples()); err != nil {
+		t.Fatal(err)
+	}
+	req := rec.requests[0]
+	if req.URL.Path != "/hook" || req.Header.Get("X-Api-Key") != "k" || req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("request %s %v", req.URL, req.Header)
+	}
+	var got []sinkSample
+	if err := json.Unmarshal([]byte(rec.bodies[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Topic != "devs/gw-01/temp" || got[0].Value != 21.5 || got[1].Text != `a "b"` {
+		t.Errorf("samples %+v", got)
+	}
+}
+
+func TestPostBatchErrors(t *testing.T) {
+	for _, tc := range []struct {
+		status    int
+		permanent bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	} {
+		rec := &recorder{statuses: []int{tc.status}}
+		srv := httptest.NewServer(rec)
+		w, _ := newHTTPWriter(sinkConf{URL: srv.URL})
+		err := w.Write(testSamples())
+		srv.Close()
+		if err == nil {
+			t.Errorf("%d: no error", tc.status)
+			continue
+		}
+		if _, permanent := err.(permanentError); permanent != tc.permanent {
+			t.Errorf("%d: permanent %v, want %v", tc.status, permanent, tc.permanent)
+		}
+	}
+}
+
+func TestSinkRetries(t *testing.T) {
+	rec := &recorder{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	s, err := newSink(sinkConf{Name: "retry", Type: sinkHTTP, URL: srv.URL, MaxRetries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	s.write(testSamples())
+	// backoff of 500ms then 1s
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("retried after %s", elapsed)
+	}
+	if len(rec.requests) != 3 {
+		t.Errorf("%d requests, want 3", len(rec.requests))
+	}
+	if v := counterValue(t, sinkSamples.WithLabelValues("retry")); v != 2 {
+		t.Errorf("%v samples written, want 2", v)
+	}
+	if v := counterValue(t, sinkRetries.WithLabelValues("retry")); v != 2 {
+		t.Errorf("%v retries, want 2", v)
+	}
+}
+
+func TestSinkPermanentError(t *testing.T) {
+	rec := &recorder{statuses: []int{http.StatusBadRequest}}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	s, err := newSink(sinkConf{Name: "permanent", Type: sinkHTTP, URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.write(testSamples())
+	if len(rec.requests) != 1 {
+		t.Errorf("%d requests, a permanent error is not retried", len(rec.requests))
+	}
+	if v := counterValue(t, sinkDropped.WithLabelValues("permanent", dropWriteFailed)); v != 2 {
+		t.Errorf("%v samples dropped, want 2", v)
+	}
+}
+
+func TestSinkSkipsInvalidValues(t *testing.T) {
+	s, err := newSink(sinkConf{Name: "nan", Type: sinkHTTP, URL: "http://127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	family := NewMosquittoMetric(&topicMetric{Name: "temp"}, []string{deviceLabel})
+	ss := sinkSet{s}
+	for _, v := range []float64{math.NaN(), math.Inf(1), 1} {
+		ss.Publish("devs/gw-01/temp", series{family: family, labelValues: []string{"gw-01"}, device: "gw-01", value: v})
+	}
+	if len(s.buffer) != 1 {
+		t.Errorf("%d samples buffered, want 1", len(s.buffer))
+	}
+	if v := counterValue(t, sinkDropped.WithLabelValues("nan", dropInvalidValue)); v != 2 {
+		t.Errorf("%v samples dropped, want 2", v)
+	}
+}
+
+func TestFileWriterRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out", "samples.jsonl")
+
+	w, err := newFileWriter(sinkConf{Name: "file", Path: path, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { w.file.Close() }()
+	batch := testSamples()
+	line, _ := json.Marshal(batch[0])
+	// rotate after every third line
+	w.maxSize = int64(3 * (len(line) + 1))
+	for i := 0; i < 10; i++ {
+		if err := w.Write(batch[:1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := func(name string) int {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		n := 0
+		for sc := bufio.NewScanner(f); sc.Scan(); n++ {
+			var s sinkSample
+			if err := json.Unmarshal(sc.Bytes(), &s); err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+		}
+		return n
+	}
+	for name, want := range map[string]int{path: 1, path + ".1": 3, path + ".2": 3} {
+		if n := lines(name); n != want {
+			t.Errorf("%s holds %d lines, want %d", name, n, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 kept past maxFiles", path)
+	}
+	if w.size != int64(len(line)+1) {
+		t.Errorf("size %d, want %d", w.size, len(line)+1)
+	}
+
+	// a sample that cannot be encoded is skipped, not the batch
+	bad := batch[0]
+	bad.Value = math.Inf(-1)
+	if err := w.Write([]sinkSample{bad, batch[1]}); err != nil {
+		t.Fatal(err)
+	}
+	if n := lines(path); n != 2 {
+		t.Errorf("%s holds %d lines, want 2", path, n)
+	}
+	if v := counterValue(t, sinkDropped.WithLabelValues("file", dropInvalidValue)); v != 1 {
+		t.Errorf("%v samples dropped, want 1", v)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Types of sink.
+const (
+	sinkInfluxDB = "influxdb"
+	sinkHTTP     = "http"
+	sinkFile     = "file"
+)
+
+// Reasons a sink drops samples.
+const (
+	dropBufferFull   = "buffer_full"
+	dropWriteFailed  = "write_failed"
+	dropInvalidValue = "invalid_value"
+)
+
+type sinkConf struct {
+	Name string `json:"name"`
+	// Type is influxdb, http or file.
+	Type string `json:"type"`
+	// Topics are the topic filters of the samples sent to the sink, every
+	// sample by default.
+	Topics []string `json:"topics"`
+
+	// URL of the InfluxDB server or of the webhook.
+	URL string `json:"url"`
+	// Database, RetentionPolicy, Username and Password address InfluxDB 1.x,
+	// Org, Bucket and Token InfluxDB 2.x.
+	Database        string `json:"database"`
+	RetentionPolicy string `json:"retentionPolicy"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	Org             string `json:"org"`
+	Bucket          string `json:"bucket"`
+	Token           string `json:"token"`
+	// Measurement names the InfluxDB measurement, the metric name by
+	// default.
+	Measurement string `json:"measurement"`
+	// Headers are added to the webhook requests.
+	Headers map[string]string `json:"headers"`
+
+	// Path of the JSON-lines file, rotated to path.1 .. path.N once it
+	// reaches MaxSizeMB.
+	Path      string `json:"path"`
+	MaxSizeMB int    `json:"maxSizeMB"`
+	MaxFiles  int    `json:"maxFiles"`
+
+	BatchSize       int `json:"batchSize"`
+	FlushIntervalMs int `json:"flushIntervalMs"`
+	// BufferSize bounds the samples waiting for the sink, the oldest are
+	// dropped once it is full.
+	BufferSize int `json:"bufferSize"`
+	MaxRetries int `json:"maxRetries"`
+	TimeoutSec int `json:"timeoutSec"`
+}
+
+// sinkSample is a sample as sent to the sinks.
+type sinkSample struct {
+	Topic string `json:"topic"`
+	latestValue
+}
+
+// Time is the source timestamp of the sample, or its arrival time.
+func (s sinkSample) Time() time.Time {
+	if s.SourceTimestamp != nil {
+		return *s.SourceTimestamp
+	}
+	return s.Updated
+}
+
+// sinkWriter delivers a batch to a destination.
+type sinkWriter interface {
+	Write(batch []sinkSample) error
+}
+
+// permanentError is a write failure retrying cannot fix.
+type permanentError struct {
+	error
+}
+
+var (
+	sinkSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_exporter_sink_samples_total",
+		Help: "Number of samples written to the sink.",
+	}, []string{"sink"})
+	sinkDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_exporter_sink_dropped_total",
+		Help: "Number of samples the sink dropped.",
+	}, []string{"sink", "reason"})
+	sinkRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_exporter_sink_retries_total",
+		Help: "Number of retried sink writes.",
+	}, []string{"sink"})
+)
+
+// sink batches the samples of a writer, retrying with backoff.
+type sink struct {
+	conf   sinkConf
+	writer sinkWriter
+	buffer chan sinkSample
+}
+
+func newSink(conf sinkConf) (*sink, error) {
+	if conf.Name == "" {
+		conf.Name = conf.Type
+	}
+	if len(conf.Topics) == 0 {
+		conf.Topics = []string{"#"}
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 500
+	}
+	if conf.FlushIntervalMs <= 0 {
+		conf.FlushIntervalMs = 1000
+	}
+	if conf.BufferSize <= 0 {
+		conf.BufferSize = 10000
+	}
+	if conf.MaxRetries <= 0 {
+		conf.MaxRetries = 5
+	}
+	if conf.TimeoutSec <= 0 {
+		conf.TimeoutSec = 10
+	}
+
+	var writer sinkWriter
+	var err error
+	switch conf.Type {
+	case sinkInfluxDB:
+		writer, err = newInfluxWriter(conf)
+	case sinkHTTP:
+		writer, err = newHTTPWriter(conf)
+	case sinkFile:
+		writer, err = newFileWriter(conf)
+	default:
+		err = fmt.Errorf("unknown type %q", conf.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: %s", conf.Name, err)
+	}
+	return &sink{conf: conf, writer: writer, buffer: make(chan sinkSample, conf.BufferSize)}, nil
+}
+
+func (s *sink) accepts(topic string) bool {
+	for _, filter := range s.conf.Topics {
+		if _, ok := matchTopic(filter, topic); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue buffers a sample, dropping the oldest one when the buffer is full.
+func (s *sink) enqueue(sample sinkSample) {
+	for {
+		select {
+		case s.buffer <- sample:
+			return
+		default:
+		}
+		select {
+		case <-s.buffer:
+			sinkDropped.WithLabelValues(s.conf.Name, dropBufferFull).Inc()
+		default:
+		}
+	}
+}
+
+func (s *sink) run() {
+	ticker := time.NewTicker(time.Duration(s.conf.FlushIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+	batch := make([]sinkSample, 0, s.conf.BatchSize)
+	for {
+		select {
+		case sample := <-s.buffer:
+			batch = append(batch, sample)
+			if len(batch) < s.conf.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		s.write(batch)
+		batch = make([]sinkSample, 0, s.conf.BatchSize)
+	}
+}
+
+// write delivers a batch, retrying with an exponential backoff.
+func (s *sink) write(batch []sinkSample) {
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := s.writer.Write(batch)
+		if err == nil {
+			sinkSamples.WithLabelValues(s.conf.Name).Add(float64(len(batch)))
+			return
+		}
+		_, permanent := err.(permanentError)
+		if permanent || attempt >= s.conf.MaxRetries {
+			log.Printf("Sink %s dropped %d samples: %s", s.conf.Name, len(batch), err)
+			sinkDropped.WithLabelValues(s.conf.Name, dropWriteFailed).Add(float64(len(batch)))
+			return
+		}
+		log.Printf("Sink %s write failed, retrying in %s: %s", s.conf.Name, backoff, err)
+		sinkRetries.WithLabelValues(s.conf.Name).Inc()
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// sinkSet fans the processed samples out to the configured sinks.
+type sinkSet []*sink
+
+func newSinkSet(confs []sinkConf) (sinkSet, error) {
+	sinks := sinkSet{}
+	for _, conf := range confs {
+		s, err := newSink(conf)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// Start runs every sink in the background.
+func (ss sinkSet) Start() {
+	for _, s := range ss {
+		go s.run()
+	}
+}
+
+// Publish sends an updated series received on topic to the sinks
+// accepting it. NaN and infinite values cannot be written by any sink, they
+// are dropped here rather than failing the whole batch.
+func (ss sinkSet) Publish(topic string, series series) {
+	invalid := math.IsNaN(series.value) || math.IsInf(series.value, 0)
+	var sample *sinkSample
+	for _, s := range ss {
+		if !s.accepts(topic) {
+			continue
+		}
+		if invalid {
+			sinkDropped.WithLabelValues(s.conf.Name, dropInvalidValue).Inc()
+			continue
+		}
+		if sample == nil {
+			sample = &sinkSample{Topic: topic, latestValue: newLatestValue(series, presenceTracker)}
+		}
+		s.enqueue(*sample)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MOXA-ISD/edge-ha/pkg/sparkplug"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type spbDevice struct {
+	online bool
+}
+
+type spbNode struct {
+	online  bool
+	bdSeq   uint64
+	seq     uint64
+	aliases map[uint64]string
+	devices map[string]*spbDevice
+}
+
+// spbValue is a decoded metric value waiting to be ingested.
+type spbValue struct {
+	labelValues []string
+	value       float64
+	ts          time.Time
+}
+
+// SparkplugCollector keeps the state of every Sparkplug B edge node seen on
+// the broker and exports it with group/node/device labels. The metric
+// values are ingested into the store like the topic metrics, the edge node
+// is their device.
+type SparkplugCollector struct {
+	values     *MosquittoMetric
+	nodeDesc   *prometheus.Desc
+	deviceDesc *prometheus.Desc
+
+	mu    sync.Mutex
+	nodes map[[2]string]*spbNode
+}
+
+// NewSparkplugCollector get a new one
+func NewSparkplugCollector() *SparkplugCollector {
+	values := NewMosquittoMetric(&topicMetric{
+		Name: "sparkplug_metric_value",
+		Help: "Last value of a Sparkplug B metric.",
+		Type: typeGauge,
+	}, []string{"group", "node", "device", "metric"})
+	// the edge node is what connects to the broker, the Sparkplug device
+	// is only a label
+	values.deviceIndex = 1
+	return &SparkplugCollector{
+		values: values,
+		nodeDesc: prometheus.NewDesc(
+			"sparkplug_node_online",
+			"Whether the Sparkplug B edge node is online.",
+			[]string{"group", "node"},
+			nil,
+		),
+		deviceDesc: prometheus.NewDesc(
+			"sparkplug_device_online",
+			"Whether the Sparkplug B device is online.",
+			[]string{"group", "node", "device"},
+			nil,
+		),
+		nodes: map[[2]string]*spbNode{},
+	}
+}
+
+// Process handles one message received on spBv1.0/#.
+func (c *SparkplugCollector) Process(topic string, payload []byte) {
+	// the host applications announce themselves on spBv1.0/STATE/{host},
+	// a topic too short for ParseTopic
+	if strings.HasPrefix(topic, sparkplug.Namespace+"/"+sparkplug.STATE+"/") {
+		return
+	}
+	t, err := sparkplug.ParseTopic(topic)
+	if err != nil {
+		log.Printf("invalid sparkplug topic %s", topic)
+		parseFailures.WithLabelValues(failInvalidTopic).Inc()
+		return
+	}
+	if t.Type == sparkplug.STATE || t.Type == sparkplug.NCMD || t.Type == sparkplug.DCMD {
+		return
+	}
+	if exporterLimits != nil && !exporterLimits.AllowDevice(t.Node, topic) {
+		return
+	}
+	p, err := sparkplug.Unmarshal(payload)
+	if err != nil {
+		log.Printf("invalid sparkplug payload on %s: %s", topic, err)
+		parseFailures.WithLabelValues(failInvalidSparkplug).Inc()
+		return
+	}
+
+	arrival := time.Now()
+	presenceTracker.Seen(t.Node)
+	if deviceRegistry != nil {
+		deviceRegistry.Observe(t.Node)
+	}
+	if p.Timestamp != 0 && clockMonitor != nil {
+		clockMonitor.Observe(t.Node, millisTime(p.Timestamp), arrival)
+	}
+
+	values, dead := c.apply(t, p)
+	if dead != "" {
+		n := metricStore.remove(expiredOffline, func(ss *series) bool {
+			return ss.family == c.values && ss.labelValues[0] == t.Group && ss.labelValues[1] == t.Node &&
+				(t.Type == sparkplug.NDEATH || ss.labelValues[2] == t.Device)
+		})
+		if t.Type == sparkplug.NDEATH {
+			presenceTracker.Status(t.Node, false, "")
+		}
+		if n > 0 {
+			log.Printf("Removed %d sparkplug series of %s", n, dead)
+		}
+	}
+	for _, v := range values {
+		ingestValue(c.values, topic, v.labelValues, v.value, v.ts)
+	}
+}
+
+// apply updates the state of the node and returns the values carried by
+// the message, or the node or device that died.
+func (c *SparkplugCollector) apply(t sparkplug.Topic, p *sparkplug.Payload) ([]spbValue, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := [2]string{t.Group, t.Node}
+	node := c.nodes[key]
+	if t.Type == sparkplug.NBIRTH || node == nil {
+		if t.Type != sparkplug.NBIRTH {
+			log.Printf("sparkplug %s from %s/%s before NBIRTH", t.Type, t.Group, t.Node)
+		}
+		node = &spbNode{
+			aliases: map[uint64]string{},
+			devices: map[string]*spbDevice{},
+		}
+		c.nodes[key] = node
+	}
+	if p.HasSeq && t.Type != sparkplug.NBIRTH && node.online && p.Seq != node.seq {
+		log.Printf("sparkplug seq gap from %s/%s: want %d, got %d", t.Group, t.Node, node.seq, p.Seq)
+	}
+	if p.HasSeq {
+		node.seq = (p.Seq + 1) % 256
+	}
+
+	switch t.Type {
+	case sparkplug.NBIRTH:
+		node.online = true
+		for _, m := range p.Metrics {
+			if m.Name == sparkplug.BdSeqMetric {
+				node.bdSeq, _ = m.Value.(uint64)
+			}
+		}
+		return node.values(t, p, true), ""
+	case sparkplug.NDATA:
+		return node.values(t, p, false), ""
+	case sparkplug.NDEATH:
+		for _, m := range p.Metrics {
+			if bdSeq, ok := m.Value.(uint64); ok && m.Name == sparkplug.BdSeqMetric && bdSeq != node.bdSeq {
+				// a stale will from a previous session
+				return nil, ""
+			}
+		}
+		node.online = false
+		for _, d := range node.devices {
+			d.online = false
+		}
+		return nil, t.Group + "/" + t.Node
+	case sparkplug.DBIRTH:
+		node.devices[t.Device] = &spbDevice{online: true}
+		return node.values(t, p, true), ""
+	case sparkplug.DDATA:
+		if node.devices[t.Device] == nil {
+			log.Printf("sparkplug DDATA from %s/%s/%s before DBIRTH", t.Group, t.Node, t.Device)
+			return nil, ""
+		}
+		return node.values(t, p, false), ""
+	case sparkplug.DDEATH:
+		if d := node.devices[t.Device]; d != nil {
+			d.online = false
+		}
+		return nil, t.Group + "/" + t.Node + "/" + t.Device
+	}
+	return nil, ""
+}
+
+// values resolves the metric names of a message, births register the
+// aliases used by the data messages that follow. Metrics without a numeric
+// value are not exported.
+func (n *spbNode) values(t sparkplug.Topic, p *sparkplug.Payload, birth bool) []spbValue {
+	values := make([]spbValue, 0, len(p.Metrics))
+	for _, m := range p.Metrics {
+		name := m.Name
+		if birth && m.HasAlias && name != "" {
+			n.aliases[m.Alias] = name
+		}
+		if name == "" && m.HasAlias {
+			name = n.aliases[m.Alias]
+		}
+		if name == "" {
+			log.Printf("sparkplug metric with unknown alias %d", m.Alias)
+			continue
+		}
+		value, ok := m.Float64()
+		if !ok {
+			continue
+		}
+		ts := m.Timestamp
+		if ts == 0 {
+			ts = p.Timestamp
+		}
+		v := spbValue{labelValues: []string{t.Group, t.Node, t.Device, name}, value: value}
+		if ts != 0 {
+			v.ts = millisTime(ts)
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func millisTime(ms uint64) time.Time {
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
+
+// Describe sends the descriptors of the sparkplug metrics.
+func (c *SparkplugCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.nodeDesc
+	ch <- c.deviceDesc
+}
+
+// Collect exports the current state of every node and device, the values
+// are exported by the store.
+func (c *SparkplugCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, node := range c.nodes {
+		group, nodeID := key[0], key[1]
+		ch <- prometheus.MustNewConstMetric(c.nodeDesc, prometheus.GaugeValue, boolValue(node.online), group, nodeID)
+		for deviceID, d := range node.devices {
+			ch <- prometheus.MustNewConstMetric(c.deviceDesc, prometheus.GaugeValue, boolValue(d.online), group, nodeID, deviceID)
+		}
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestSparkplugStateTopic(t *testing.T) {
+	c := NewSparkplugCollector()
+	before := counterValue(t, parseFailures.WithLabelValues(failInvalidTopic))
+	c.Process("spBv1.0/STATE/scada-01", []byte(`{"online":true,"timestamp":1500000000000}`))
+	if after := counterValue(t, parseFailures.WithLabelValues(failInvalidTopic)); after != before {
+		t.Error("the STATE topic of a host application counted as invalid")
+	}
+	c.Process("spBv1.0/edge", nil)
+	if after := counterValue(t, parseFailures.WithLabelValues(failInvalidTopic)); after != before+1 {
+		t.Error("a short topic not counted as invalid")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons a message fails to parse.
+const (
+	failInvalidJSON      = "invalid_json"
+	failInvalidNumber    = "invalid_number"
+	failUnknownState     = "unknown_state"
+	failMissingValue     = "missing_value"
+	failInvalidType      = "invalid_type"
+	failInvalidBatch     = "invalid_batch"
+	failInvalidTopic     = "invalid_topic"
+	failInvalidSparkplug = "invalid_sparkplug"
+	failLabelConflict    = "label_conflict"
+)
+
+// The exporter instruments its own ingestion so that alerts fire when it
+// silently stops receiving or understanding messages.
+var (
+	messagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_exporter_messages_received_total",
+		Help: "Number of messages received per topic pattern.",
+	}, []string{"pattern"})
+	parseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_exporter_parse_failures_total",
+		Help: "Number of messages that could not be parsed.",
+	}, []string{"reason"})
+	unknownTopics = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_exporter_unknown_topics_total",
+		Help: "Number of messages dropped because no metric matches their topic.",
+	})
+	processingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mqtt_exporter_message_processing_seconds",
+		Help:    "Time spent processing a received message.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 8),
+	})
+	brokerConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_exporter_broker_connected",
+		Help: "Whether the exporter is connected to the broker.",
+	})
+	brokerReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_exporter_broker_reconnects_total",
+		Help: "Number of times the exporter reconnected to the broker.",
+	})
+	relabelDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_exporter_relabel_dropped_total",
+		Help: "Number of messages dropped by the relabel rules.",
+	})
+)
+
+func registerStats(store *seriesStore) {
+	prometheus.MustRegister(
+		messagesReceived,
+		parseFailures,
+		unknownTopics,
+		processingDuration,
+		brokerConnected,
+		brokerReconnects,
+		relabelDropped,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mqtt_exporter_series",
+			Help: "Number of series held by the exporter.",
+		}, func() float64 { return float64(store.Len()) }),
+	)
+}
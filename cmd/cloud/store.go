@@ -0,0 +1,252 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const storeShards = 16
+
+// Reasons a series is removed from the store.
+const (
+	expiredTTL     = "ttl"
+	expiredOffline = "offline"
+	expiredCleared = "cleared"
+	expiredPurged  = "purged"
+)
+
+var seriesExpired = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mqtt_exporter_series_expired_total",
+	Help: "Number of series removed from the exporter.",
+}, []string{"metric", "reason"})
+
+type series struct {
+	family      *MosquittoMetric
+	labelValues []string
+	topic       string
+	device      string
+	updated     time.Time
+	// timestamp is the time the source stamped the value with, if any
+	timestamp time.Time
+	// invalid is set when the last payload could not be parsed, the value
+	// is the last valid one
+	invalid bool
+	value   float64
+	text    string
+}
+
+type storeShard struct {
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+// seriesStore holds every series of the topic metrics. Ingestion only locks
+// the shard of the series it updates, a snapshot locks all of them so a
+// scrape never sees a half applied update.
+type seriesStore struct {
+	shards [storeShards]*storeShard
+}
+
+func newSeriesStore() *seriesStore {
+	s := &seriesStore{}
+	for i := range s.shards {
+		s.shards[i] = &storeShard{series: map[string]*series{}}
+	}
+	return s
+}
+
+func seriesKey(family *MosquittoMetric, labelValues []string) string {
+	return family.Name + "\xff" + strings.Join(labelValues, "\xff")
+}
+
+func (s *seriesStore) shard(key string) *storeShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum32()%storeShards]
+}
+
+// Update parses a payload received on topic and applies it to the series
+// of the family, the series is left untouched when the payload is invalid.
+// ts is the source timestamp of the payload, zero when it has none. It
+// returns a copy of the updated series.
+func (s *seriesStore) Update(family *MosquittoMetric, topic string, labelValues []string, payload string, ts time.Time) (series, bool) {
+	value, text, ok := family.parse(payload)
+	if !ok {
+		key := seriesKey(family, labelValues)
+		sh := s.shard(key)
+		sh.mu.Lock()
+		if ss := sh.series[key]; ss != nil {
+			ss.invalid = true
+		}
+		sh.mu.Unlock()
+		return series{}, false
+	}
+	return s.Set(family, topic, labelValues, value, text, ts)
+}
+
+// Set applies an already parsed value to the series of the family, as
+// Update does.
+func (s *seriesStore) Set(family *MosquittoMetric, topic string, labelValues []string, value float64, text string, ts time.Time) (series, bool) {
+	key := seriesKey(family, labelValues)
+	sh := s.shard(key)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	ss := sh.series[key]
+	if ss == nil {
+		ss = &series{family: family, labelValues: labelValues}
+		if family.deviceIndex >= 0 {
+			ss.device = labelValues[family.deviceIndex]
+		}
+		if exporterLimits != nil && !exporterLimits.admitSeries(ss.device, topic) {
+			return series{}, false
+		}
+		sh.series[key] = ss
+	}
+	ss.topic = topic
+	ss.updated = time.Now()
+	ss.timestamp = ts
+	ss.invalid = false
+	family.apply(ss, value, text)
+	return *ss, true
+}
+
+// remove drops every series accepted by match.
+func (s *seriesStore) remove(reason string, match func(ss *series) bool) int {
+	n := 0
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for key, ss := range sh.series {
+			if match(ss) {
+				delete(sh.series, key)
+				seriesExpired.WithLabelValues(ss.family.Name, reason).Inc()
+				if exporterLimits != nil {
+					exporterLimits.removedSeries(ss.device)
+				}
+				n++
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// Expire drops the series not updated within the TTL of their family.
+func (s *seriesStore) Expire(now time.Time) {
+	n := s.remove(expiredTTL, func(ss *series) bool {
+		return ss.family.TTL > 0 && now.Sub(ss.updated) > ss.family.TTL
+	})
+	if n > 0 {
+		log.Printf("Expired %d series", n)
+	}
+}
+
+// RemoveDevice drops the series of a device that went offline, except the
+// ones of the status topic itself.
+func (s *seriesStore) RemoveDevice(device, statusTopic string) {
+	n := s.remove(expiredOffline, func(ss *series) bool {
+		return ss.device == device && ss.topic != statusTopic
+	})
+	if n > 0 {
+		log.Printf("Removed %d series of offline device %s", n, device)
+	}
+}
+
+// RemoveTopic drops the series fed by a topic whose retained message was
+// cleared.
+func (s *seriesStore) RemoveTopic(topic string) {
+	n := s.remove(expiredCleared, func(ss *series) bool {
+		return ss.topic == topic
+	})
+	if n > 0 {
+		log.Printf("Removed %d series of cleared topic %s", n, topic)
+	}
+}
+
+// PurgeDevice drops every series of a device released from quarantine.
+func (s *seriesStore) PurgeDevice(device string) {
+	n := s.remove(expiredPurged, func(ss *series) bool {
+		return ss.device == device
+	})
+	if clockMonitor != nil {
+		clockMonitor.Forget(device)
+	}
+	log.Printf("Purged %d series of device %s", n, device)
+}
+
+// Snapshot copies every series.
+func (s *seriesStore) Snapshot() []series {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+	}
+	defer func() {
+		for _, sh := range s.shards {
+			sh.mu.RUnlock()
+		}
+	}()
+
+	snapshot := make([]series, 0, s.lenLocked())
+	for _, sh := range s.shards {
+		for _, ss := range sh.series {
+			snapshot = append(snapshot, *ss)
+		}
+	}
+	return snapshot
+}
+
+// Len returns the number of series.
+func (s *seriesStore) Len() int {
+	n := 0
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		n += len(sh.series)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+func (s *seriesStore) lenLocked() int {
+	n := 0
+	for _, sh := range s.shards {
+		n += len(sh.series)
+	}
+	return n
+}
+
+// Exporter is the collector of every topic metric. The families created by
+// the relabel rules are exported by a separate dynamic exporter, which
+// describes nothing as its families are not known upfront.
+type Exporter struct {
+	families []*MosquittoMetric
+	store    *seriesStore
+	dynamic  bool
+}
+
+// NewExporter get a new one
+func NewExporter(families []*MosquittoMetric, store *seriesStore) *Exporter {
+	return &Exporter{
+		families: families,
+		store:    store,
+	}
+}
+
+// Describe sends the Desc of every family.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, f := range e.families {
+		ch <- f.Desc
+	}
+}
+
+// Collect exports a consistent snapshot of the store.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range e.store.Snapshot() {
+		if s.family.dynamic == e.dynamic {
+			s.family.collect(ch, s)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestStoreConcurrentUpdateCollect runs the ingestion and the scrapes in
+// parallel, it is meant to be run with -race.
+func TestStoreConcurrentUpdateCollect(t *testing.T) {
+	families := []*MosquittoMetric{
+		NewMosquittoMetric(&topicMetric{Name: "test_temperature", Help: "t", Type: typeGauge}, []string{deviceLabel, "tag"}),
+		NewMosquittoMetric(&topicMetric{Name: "test_messages_total", Help: "t", Type: typeCounter}, []string{deviceLabel}),
+		NewMosquittoMetric(&topicMetric{Name: "test_firmware_info", Help: "t", Type: typeInfo}, []string{deviceLabel}),
+	}
+	store := newSeriesStore()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(families, store))
+
+	const (
+		writers = 8
+		devices = 20
+		rounds  = 200
+	)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				device := fmt.Sprintf("gw-%02d", (w+i)%devices)
+				topic := "devs/" + device
+				store.Update(families[0], topic+"/temp", []string{device, fmt.Sprint(w)}, fmt.Sprintf(`{"value":%d}`, i), time.Time{})
+				store.Update(families[1], topic+"/count", []string{device}, fmt.Sprintf(`{"value":%d}`, i), time.Now())
+				store.Update(families[2], topic+"/fw", []string{device}, fmt.Sprintf(`{"value":"1.%d"}`, i), time.Time{})
+				if i%50 == 49 {
+					store.RemoveDevice(device, topic+"/status")
+				}
+			}
+		}(w)
+	}
+
+	var scrapes sync.WaitGroup
+	scrapes.Add(1)
+	go func() {
+		defer scrapes.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			mfs, err := reg.Gather()
+			if err != nil {
+				t.Errorf("gather: %s", err)
+				return
+			}
+			for _, mf := range mfs {
+				if len(mf.GetMetric()) == 0 {
+					t.Errorf("%s gathered without metrics", mf.GetName())
+				}
+			}
+			store.Len()
+			store.Expire(time.Now())
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	scrapes.Wait()
+
+	if n, want := store.Len(), len(store.Snapshot()); n != want {
+		t.Errorf("Len %d, snapshot of %d series", n, want)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := 0
+	for _, mf := range mfs {
+		got += len(mf.GetMetric())
+	}
+	if got != store.Len() {
+		t.Errorf("gathered %d series, the store holds %d", got, store.Len())
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/websocket"
+)
+
+// Transports of the live stream.
+const (
+	transportWebSocket = "websocket"
+	transportSSE       = "sse"
+)
+
+const sseKeepalive = 15 * time.Second
+
+type streamConf struct {
+	// MaxClients bounds the connected stream clients of both transports.
+	MaxClients int `json:"maxClients"`
+	// QueueSize is the number of updates buffered per client, updates are
+	// dropped while a client does not keep up.
+	QueueSize int `json:"queueSize"`
+}
+
+var (
+	streamClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mqtt_exporter_stream_clients",
+		Help: "Number of connected live stream clients.",
+	}, []string{"transport"})
+	streamDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_exporter_stream_dropped_total",
+		Help: "Number of updates dropped because a stream client did not keep up.",
+	}, []string{"transport"})
+)
+
+// streamFilter selects the updates of a client, Filters are MQTT style
+// filters on "device/tag".
+type streamFilter struct {
+	Filters []string `json:"filters"`
+	Source  string   `json:"src"`
+}
+
+func (f streamFilter) match(v latestValue) bool {
+	if f.Source != "" && f.Source != v.Source {
+		return false
+	}
+	for _, filter := range f.Filters {
+		if _, ok := matchTopic(filter, v.Device+"/"+v.Tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type streamClient struct {
+	transport string
+	updates   chan latestValue
+
+	mu      sync.Mutex
+	filter  streamFilter
+	dropped int
+}
+
+// takeDropped returns and resets the number of updates dropped.
+func (c *streamClient) takeDropped() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.dropped
+	c.dropped = 0
+	return n
+}
+
+func (c *streamClient) setFilter(f streamFilter) {
+	if len(f.Filters) == 0 {
+		f.Filters = []string{"#"}
+	}
+	c.mu.Lock()
+	c.filter = f
+	c.mu.Unlock()
+}
+
+// StreamHub pushes the tag updates to the WebSocket and SSE clients.
+type StreamHub struct {
+	conf     streamConf
+	presence *PresenceTracker
+
+	mu      sync.Mutex
+	clients map[*streamClient]bool
+}
+
+// NewStreamHub get a new one
+func NewStreamHub(conf streamConf, presence *PresenceTracker) *StreamHub {
+	if conf.MaxClients <= 0 {
+		conf.MaxClients = 100
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = 256
+	}
+	return &StreamHub{
+		conf:     conf,
+		presence: presence,
+		clients:  map[*streamClient]bool{},
+	}
+}
+
+// Publish sends an updated series to the clients whose filters match it.
+func (h *StreamHub) Publish(ss series) {
+	if ss.device == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) == 0 {
+		return
+	}
+	v := newLatestValue(ss, h.presence)
+	for c := range h.clients {
+		c.mu.Lock()
+		if c.filter.match(v) {
+			select {
+			case c.updates <- v:
+			default:
+				c.dropped++
+				streamDropped.WithLabelValues(c.transport).Inc()
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// join registers a client, false when the hub is full.
+func (h *StreamHub) join(transport string, r *http.Request) (*streamClient, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) >= h.conf.MaxClients {
+		return nil, false
+	}
+	c := &streamClient{transport: transport, updates: make(chan latestValue, h.conf.QueueSize)}
+	c.setFilter(streamFilter{Filters: r.URL.Query()["filter"], Source: r.URL.Query().Get("src")})
+	h.clients[c] = true
+	streamClients.WithLabelValues(transport).Inc()
+	return c, true
+}
+
+func (h *StreamHub) leave(c *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+	streamClients.WithLabelValues(c.transport).Dec()
+}
+
+// WebSocket streams the updates as json messages, the client may send a
+// {"filters": [...], "src": ""} message to change its subscription.
+func (h *StreamHub) WebSocket() http.Handler {
+	return websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		c, ok := h.join(transportWebSocket, ws.Request())
+		if !ok {
+			websocket.JSON.Send(ws, map[string]string{"error": "too many clients"})
+			return
+		}
+		defer h.leave(c)
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				var f streamFilter
+				if err := websocket.JSON.Receive(ws, &f); err != nil {
+					return
+				}
+				c.setFilter(f)
+			}
+		}()
+		for {
+			select {
+			case v := <-c.updates:
+				if n := c.takeDropped(); n > 0 {
+					if err := websocket.JSON.Send(ws, map[string]int{"dropped": n}); err != nil {
+						return
+					}
+				}
+				if err := websocket.JSON.Send(ws, v); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	})
+}
+
+// ServeSSE streams the updates as server-sent "tag" events, a "dropped"
+// event tells how many updates were lost when the client lags behind.
+func (h *StreamHub) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	c, ok := h.join(transportSSE, r)
+	if !ok {
+		http.Error(w, "too many clients", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.leave(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case v := <-c.updates:
+			if n := c.takeDropped(); n > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", n)
+			}
+			data, err := json.Marshal(v)
+			if err != nil {
+				log.Printf("stream: %s", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: tag\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+// sysPrefix is the root of the broker statistics topics.
+const sysPrefix = "$SYS/"
+
+// sysTopicMetrics maps the mosquitto $SYS/broker topics onto metrics, their
+// payloads are plain text like "42" or "3600 seconds".
+func sysTopicMetrics() []*topicMetric {
+	metrics := []*topicMetric{}
+	add := func(topic, name, help, typ string) {
+		metrics = append(metrics, &topicMetric{
+			Pattern: "$SYS/broker/" + topic,
+			Name:    name,
+			Help:    help,
+			Type:    typ,
+			Format:  formatText,
+		})
+	}
+	add("clients/connected", "mosquitto_clients_connected", "Number of connected clients.", typeGauge)
+	add("clients/disconnected", "mosquitto_clients_disconnected", "Number of persistent clients currently disconnected.", typeGauge)
+	add("clients/total", "mosquitto_clients_total", "Number of active and inactive clients.", typeGauge)
+	add("clients/maximum", "mosquitto_clients_maximum", "Maximum number of clients connected at the same time.", typeGauge)
+	add("clients/expired", "mosquitto_clients_expired", "Number of disconnected persistent clients that have been expired.", typeGauge)
+	add("messages/received", "mosquitto_messages_received_total", "Number of messages of any type received since the broker started.", typeCounter)
+	add("messages/sent", "mosquitto_messages_sent_total", "Number of messages of any type sent since the broker started.", typeCounter)
+	add("messages/stored", "mosquitto_messages_stored", "Number of messages currently held in the message store.", typeGauge)
+	add("messages/inflight", "mosquitto_messages_inflight", "Number of messages with QoS>0 awaiting acknowledgments.", typeGauge)
+	add("publish/messages/received", "mosquitto_publish_messages_received_total", "Number of PUBLISH messages received since the broker started.", typeCounter)
+	add("publish/messages/sent", "mosquitto_publish_messages_sent_total", "Number of PUBLISH messages sent since the broker started.", typeCounter)
+	add("publish/messages/dropped", "mosquitto_publish_messages_dropped_total", "Number of PUBLISH messages dropped due to inflight or queue limits.", typeCounter)
+	add("publish/bytes/received", "mosquitto_publish_bytes_received_total", "Number of PUBLISH payload bytes received since the broker started.", typeCounter)
+	add("publish/bytes/sent", "mosquitto_publish_bytes_sent_total", "Number of PUBLISH payload bytes sent since the broker started.", typeCounter)
+	add("bytes/received", "mosquitto_bytes_received_total", "Number of bytes received since the broker started.", typeCounter)
+	add("bytes/sent", "mosquitto_bytes_sent_total", "Number of bytes sent since the broker started.", typeCounter)
+	add("retained messages/count", "mosquitto_retained_messages", "Number of retained messages on the broker.", typeGauge)
+	add("subscriptions/count", "mosquitto_subscriptions", "Number of subscriptions on the broker.", typeGauge)
+	add("store/messages/count", "mosquitto_store_messages", "Number of messages in the message store.", typeGauge)
+	add("store/messages/bytes", "mosquitto_store_messages_bytes", "Number of payload bytes in the message store.", typeGauge)
+	add("heap/current", "mosquitto_heap_current_bytes", "Heap memory in use by the broker.", typeGauge)
+	add("heap/maximum", "mosquitto_heap_maximum_bytes", "Largest heap memory used by the broker.", typeGauge)
+	add("uptime", "mosquitto_uptime_seconds", "Time the broker has been running.", typeCounter)
+	add("version", "mosquitto_version_info", "Version of the broker.", typeInfo)
+	metrics[len(metrics)-1].ValueLabel = "version"
+
+	metrics = append(metrics,
+		&topicMetric{
+			Pattern: "$SYS/broker/load/+/+/+",
+			Name:    "mosquitto_load",
+			Help:    "Moving average of the broker load per minute.",
+			Type:    typeGauge,
+			Format:  formatText,
+			Labels:  []string{"kind", "direction", "interval"},
+		},
+		&topicMetric{
+			Pattern: "$SYS/broker/load/+/+",
+			Name:    "mosquitto_load_events",
+			Help:    "Moving average of connections or sockets opened per minute.",
+			Type:    typeGauge,
+			Format:  formatText,
+			Labels:  []string{"kind", "interval"},
+		},
+	)
+	return metrics
+}
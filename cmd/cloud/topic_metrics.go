@@ -0,0 +1,198 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+// topicMetric maps an mqtt topic pattern onto a metric family, the topic
+// levels matched by the wildcards become the labels.
+type topicMetric struct {
+	Pattern string `json:"topic"`
+	Name    string `json:"name"`
+	Help    string `json:"help"`
+	// Type is one of gauge, counter, info or stateset, gauge by default.
+	Type string `json:"type"`
+	// Labels names the wildcard levels of the pattern, in order.
+	Labels []string `json:"labels"`
+	// PayloadLabels adds labels read from the json payload, label -> path.
+	PayloadLabels map[string]string `json:"payloadLabels"`
+	// States maps the payload value of a stateset onto its state name.
+	States map[string]string `json:"states"`
+	// TTL drops a series not updated for this long, e.g. "10m".
+	TTL string `json:"ttl"`
+	// Format of the payload, json by default or text for plain values.
+	Format string `json:"format"`
+	// ValueLabel names the label carrying the value of an info metric.
+	ValueLabel string `json:"valueLabel"`
+	// ValuePath is the gjson path of the value in the payload, "value" by
+	// default, e.g. "data.temperature".
+	ValuePath string `json:"valuePath"`
+	// Enum maps string values onto numbers, e.g. {"RUN": 1, "STOP": 0}.
+	Enum map[string]float64 `json:"enum"`
+	// Fields turns a payload carrying several values into one metric per
+	// field, named <name>_<field>, field -> gjson path.
+	Fields map[string]string `json:"fields"`
+	// SourceTimestamp exports the samples with the time the device stamped
+	// them with instead of the scrape time.
+	SourceTimestamp bool `json:"sourceTimestamp"`
+	// TimestampPath is the gjson path of the RFC3339 device timestamp,
+	// "timestamp" by default.
+	TimestampPath string `json:"timestampPath"`
+
+	ttl           time.Duration
+	payloadLabels []string
+	metrics       []*MosquittoMetric
+}
+
+func (m *topicMetric) register() {
+	m.payloadLabels = []string{}
+	for l := range m.PayloadLabels {
+		m.payloadLabels = append(m.payloadLabels, l)
+	}
+	sort.Strings(m.payloadLabels)
+
+	labels := append(append([]string{}, m.Labels...), m.payloadLabels...)
+	if len(m.Fields) == 0 {
+		m.metrics = []*MosquittoMetric{NewMosquittoMetric(m, labels)}
+		return
+	}
+	fields := []string{}
+	for f := range m.Fields {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	m.metrics = nil
+	for _, f := range fields {
+		field := *m
+		field.Name = m.Name + "_" + f
+		field.ValuePath = m.Fields[f]
+		m.metrics = append(m.metrics, NewMosquittoMetric(&field, labels))
+	}
+}
+
+// labelValues returns the label values of a topic, false if the topic does
+// not match the pattern.
+func (m *topicMetric) labelValues(topic, payload string) ([]string, bool) {
+	values, ok := matchTopic(m.Pattern, topic)
+	if !ok || len(values) != len(m.Labels) {
+		return nil, false
+	}
+	if m.Format == formatText {
+		return values, true
+	}
+	for _, l := range m.payloadLabels {
+		values = append(values, gjson.Get(payload, m.PayloadLabels[l]).String())
+	}
+	return values, true
+}
+
+func registerTopicMetrics() {
+	families := []*MosquittoMetric{}
+	for _, m := range topicMetrics {
+		m.register()
+		families = append(families, m.metrics...)
+	}
+	families = append(families, sparkplugMetrics.values)
+	prometheus.MustRegister(counterResets, seriesExpired, NewExporter(families, metricStore))
+	if relabeler != nil {
+		// the relabeled families are only known once their topics arrive
+		prometheus.MustRegister(&Exporter{store: metricStore, dynamic: true})
+	}
+}
+
+// processTopicMetric updates the first metric matching the topic, false if
+// none does.
+func processTopicMetric(topic, payload string) bool {
+	arrival := time.Now()
+	for _, m := range topicMetrics {
+		labelValues, ok := m.labelValues(topic, payload)
+		if !ok {
+			continue
+		}
+		messagesReceived.WithLabelValues(m.Pattern).Inc()
+		var ts time.Time
+		if m.Format != formatText {
+			path := m.TimestampPath
+			if path == "" {
+				path = "timestamp"
+			}
+			if t, ok := sourceTime(payload, path); ok {
+				ts = t
+				if i := m.metrics[0].deviceIndex; i >= 0 && clockMonitor != nil {
+					clockMonitor.Observe(labelValues[i], ts, arrival)
+				}
+			}
+		}
+		for _, family := range m.metrics {
+			ingest(family, topic, labelValues, payload, ts)
+		}
+		return true
+	}
+	return false
+}
+
+// ingest applies a payload to a series of the family and hands the updated
+// series to the consumers, false when the payload was rejected.
+func ingest(family *MosquittoMetric, topic string, labelValues []string, payload string, ts time.Time) bool {
+	ss, ok := metricStore.Update(family, topic, labelValues, payload, ts)
+	if !ok {
+		return false
+	}
+	publishSeries(topic, ss)
+	return true
+}
+
+// ingestValue is ingest for a value decoded by the caller.
+func ingestValue(family *MosquittoMetric, topic string, labelValues []string, value float64, ts time.Time) bool {
+	ss, ok := metricStore.Set(family, topic, labelValues, value, "", ts)
+	if !ok {
+		return false
+	}
+	publishSeries(topic, ss)
+	return true
+}
+
+// publishSeries hands an updated series to the consumers.
+func publishSeries(topic string, ss series) {
+	if streamHub != nil {
+		streamHub.Publish(ss)
+	}
+	if historian != nil {
+		historian.Record(ss)
+	}
+	sinks.Publish(topic, ss)
+	if remoteWrite != nil {
+		for _, ts := range remoteWriteSeries(ss) {
+			remoteWrite.Append(ts)
+		}
+	}
+}
+
+// matchTopic matches a topic against an mqtt filter and returns the levels
+// matched by the wildcards, '#' yields the remaining levels as one value.
+func matchTopic(pattern, topic string) ([]string, bool) {
+	p := strings.Split(pattern, "/")
+	t := strings.Split(topic, "/")
+	values := []string{}
+	for i, level := range p {
+		if level == "#" {
+			return append(values, strings.Join(t[i:], "/")), true
+		}
+		if i >= len(t) {
+			return nil, false
+		}
+		switch level {
+		case "+":
+			values = append(values, t[i])
+		case t[i]:
+		default:
+			return nil, false
+		}
+	}
+	return values, len(p) == len(t)
+}
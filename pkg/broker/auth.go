@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Access rights of an ACL rule.
+const (
+	accessRead      = "read"
+	accessWrite     = "write"
+	accessReadWrite = "readwrite"
+)
+
+// ACLRule grants a user access to the topics matching a filter.
+type ACLRule struct {
+	// User the rule applies to, empty or "*" for every client.
+	User string `json:"user"`
+	// Topic is a topic filter, %u is replaced by the user name and %c by
+	// the client id.
+	Topic string `json:"topic"`
+	// Access is read, write or readwrite.
+	Access string `json:"access"`
+}
+
+// authenticate checks the credentials of a CONNECT.
+func (b *Broker) authenticate(cp *packets.ConnectPacket) byte {
+	if !cp.UsernameFlag {
+		if b.conf.AllowAnonymous {
+			return packets.Accepted
+		}
+		return packets.ErrRefusedNotAuthorised
+	}
+	password, ok := b.conf.Users[cp.Username]
+	if !ok || !checkPassword(password, cp.Password) {
+		return packets.ErrRefusedBadUsernameOrPassword
+	}
+	return packets.Accepted
+}
+
+func checkPassword(want string, got []byte) bool {
+	if strings.HasPrefix(want, "sha256:") {
+		sum := sha256.Sum256(got)
+		got = []byte(hex.EncodeToString(sum[:]))
+		want = strings.ToLower(strings.TrimPrefix(want, "sha256:"))
+	}
+	return subtle.ConstantTimeCompare([]byte(want), got) == 1
+}
+
+// allowed tells whether the client may read or write topic.
+func (b *Broker) allowed(user, clientID, topic, access string) bool {
+	if len(b.conf.ACL) == 0 {
+		return true
+	}
+	for _, r := range b.conf.ACL {
+		if r.User != "" && r.User != "*" && r.User != user {
+			continue
+		}
+		if r.Access != accessReadWrite && r.Access != access {
+			continue
+		}
+		filter := strings.NewReplacer("%u", user, "%c", clientID).Replace(r.Topic)
+		if Match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,353 @@
+// Package broker is a small in-process MQTT 3.1.1 broker: plain and tls
+// listeners, retained messages, QoS 0 and 1, Last-Will, password
+// authentication and topic ACLs. QoS 2 publishes are accepted and delivered
+// at QoS 1 at most.
+package broker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const (
+	defaultMaxQueued     = 1000
+	defaultSessionExpiry = 24 * time.Hour
+	expiryInterval       = time.Minute
+)
+
+// Config of the broker.
+type Config struct {
+	Listeners []Listener `json:"listeners"`
+	// Users maps user names onto their password, a password written as
+	// "sha256:<hex>" is compared hashed.
+	Users map[string]string `json:"users"`
+	// AllowAnonymous accepts clients without credentials, the broker does
+	// not start without users unless it is set.
+	AllowAnonymous bool `json:"allowAnonymous"`
+	// ACL restricts the topics clients may publish and receive, everything
+	// is allowed without rules.
+	ACL []ACLRule `json:"acl"`
+	// MaxQueued bounds the QoS 1 messages kept for an offline persistent
+	// session and for a slow client, 1000 by default.
+	MaxQueued int `json:"maxQueued"`
+	// SessionExpirySec discards a persistent session offline for longer,
+	// a day by default.
+	SessionExpirySec int `json:"sessionExpirySec"`
+}
+
+// Listener is an address the broker accepts connections on, with tls when
+// a certificate is given.
+type Listener struct {
+	Addr string `json:"addr"`
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// Stats are the broker counters since it started.
+type Stats struct {
+	ClientsConnected int
+	Sessions         int
+	Subscriptions    int
+	Retained         int
+	MessagesReceived uint64
+	MessagesSent     uint64
+	BytesReceived    uint64
+	BytesSent        uint64
+}
+
+type message struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+// Broker routes messages between the connected clients.
+type Broker struct {
+	// the counters are first to stay 64-bit aligned for atomic access on
+	// 32-bit platforms
+	received      uint64
+	sent          uint64
+	bytesReceived uint64
+	bytesSent     uint64
+
+	conf Config
+	// OnPublish is called with every message accepted from a client, or a
+	// Last-Will, before it is routed to the subscribers.
+	OnPublish func(topic string, payload []byte, retained bool)
+
+	mu        sync.Mutex
+	sessions  map[string]*session
+	retained  map[string]*message
+	listeners []net.Listener
+	anonymous uint64
+	closed    bool
+	done      chan struct{}
+}
+
+// New returns a broker, Start opens its listeners.
+func New(conf Config) *Broker {
+	if conf.MaxQueued <= 0 {
+		conf.MaxQueued = defaultMaxQueued
+	}
+	if conf.SessionExpirySec <= 0 {
+		conf.SessionExpirySec = int(defaultSessionExpiry / time.Second)
+	}
+	return &Broker{
+		conf:     conf,
+		sessions: map[string]*session{},
+		retained: map[string]*message{},
+		done:     make(chan struct{}),
+	}
+}
+
+// Start opens every listener and accepts the clients in the background.
+func (b *Broker) Start() error {
+	if len(b.conf.Listeners) == 0 {
+		return fmt.Errorf("broker: no listener configured")
+	}
+	if len(b.conf.Users) == 0 && !b.conf.AllowAnonymous {
+		return fmt.Errorf("broker: no users configured and anonymous clients are not allowed")
+	}
+	for _, l := range b.conf.Listeners {
+		ln, err := listen(l)
+		if err != nil {
+			b.Close()
+			return fmt.Errorf("broker: listen on %s: %s", l.Addr, err)
+		}
+		b.mu.Lock()
+		b.listeners = append(b.listeners, ln)
+		b.mu.Unlock()
+		log.Printf("Broker listening on %s", ln.Addr())
+		go b.accept(ln)
+	}
+	go b.expireSessions()
+	return nil
+}
+
+func listen(l Listener) (net.Listener, error) {
+	if l.Cert == "" {
+		return net.Listen("tcp", l.Addr)
+	}
+	cert, err := tls.LoadX509KeyPair(l.Cert, l.Key)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", l.Addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+}
+
+// Close stops the listeners and disconnects every client.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	if !b.closed {
+		close(b.done)
+	}
+	b.closed = true
+	listeners := b.listeners
+	b.listeners = nil
+	sessions := make([]*session, 0, len(b.sessions))
+	for _, s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	b.mu.Unlock()
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	for _, s := range sessions {
+		if c := s.connection(); c != nil {
+			c.close()
+		}
+	}
+}
+
+func (b *Broker) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			b.mu.Lock()
+			closed := b.closed
+			b.mu.Unlock()
+			if !closed {
+				log.Printf("Broker stopped accepting on %s: %s", ln.Addr(), err)
+			}
+			return
+		}
+		go b.serve(conn)
+	}
+}
+
+// Publish routes a message originating from the broker process itself, it
+// is not passed to OnPublish.
+func (b *Broker) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	if !validTopic(topic) {
+		return fmt.Errorf("broker: invalid topic %q", topic)
+	}
+	b.route(&message{topic: topic, payload: payload, qos: qos, retain: retain})
+	return nil
+}
+
+// publish handles a message accepted from a client.
+func (b *Broker) publish(m *message) {
+	atomic.AddUint64(&b.received, 1)
+	atomic.AddUint64(&b.bytesReceived, uint64(len(m.payload)))
+	if b.OnPublish != nil {
+		b.OnPublish(m.topic, m.payload, m.retain)
+	}
+	b.route(m)
+}
+
+// route stores retained messages and delivers m to the subscribers.
+func (b *Broker) route(m *message) {
+	b.mu.Lock()
+	if m.retain {
+		if len(m.payload) == 0 {
+			delete(b.retained, m.topic)
+		} else {
+			b.retained[m.topic] = m
+		}
+	}
+	sessions := make([]*session, 0, len(b.sessions))
+	for _, s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	b.mu.Unlock()
+
+	for _, s := range sessions {
+		if qos, ok := s.subscribed(m.topic); ok {
+			if qos > m.qos {
+				qos = m.qos
+			}
+			s.deliver(m, qos, false)
+		}
+	}
+}
+
+// retainedFor returns the retained messages matching filter.
+func (b *Broker) retainedFor(filter string) []*message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msgs := []*message{}
+	for topic, m := range b.retained {
+		if Match(filter, topic) {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+func (b *Broker) sentMessage(m *message) {
+	atomic.AddUint64(&b.sent, 1)
+	atomic.AddUint64(&b.bytesSent, uint64(len(m.payload)))
+}
+
+// Stats returns the current broker counters.
+func (b *Broker) Stats() Stats {
+	b.mu.Lock()
+	st := Stats{Sessions: len(b.sessions), Retained: len(b.retained)}
+	sessions := make([]*session, 0, len(b.sessions))
+	for _, s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	b.mu.Unlock()
+
+	for _, s := range sessions {
+		s.mu.Lock()
+		if s.client != nil {
+			st.ClientsConnected++
+		}
+		st.Subscriptions += len(s.subs)
+		s.mu.Unlock()
+	}
+	st.MessagesReceived = atomic.LoadUint64(&b.received)
+	st.MessagesSent = atomic.LoadUint64(&b.sent)
+	st.BytesReceived = atomic.LoadUint64(&b.bytesReceived)
+	st.BytesSent = atomic.LoadUint64(&b.bytesSent)
+	return st
+}
+
+// attach binds a new connection to the session of its client id, taking
+// over a connection still using it. The CONNACK is queued before the session
+// can deliver anything to c. It reports whether a persistent session was
+// resumed.
+func (b *Broker) attach(cp *packets.ConnectPacket, connack *packets.ConnackPacket, c *client) (*session, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cp.ClientIdentifier == "" {
+		b.anonymous++
+		cp.ClientIdentifier = fmt.Sprintf("auto-%d", b.anonymous)
+	}
+	s := b.sessions[cp.ClientIdentifier]
+	present := s != nil && !cp.CleanSession && !s.clean
+	connack.SessionPresent = present
+	c.send(connack)
+	var old *client
+	if present {
+		old = s.takeover(c)
+	} else {
+		// the session is discarded, its connection only has to go
+		if s != nil {
+			old = s.connection()
+		}
+		s = newSession(b, cp.ClientIdentifier)
+		s.client = c
+		b.sessions[s.id] = s
+	}
+	if old != nil {
+		log.Printf("Broker: client %s taken over", cp.ClientIdentifier)
+		old.close()
+	}
+	s.mu.Lock()
+	s.user = cp.Username
+	s.clean = cp.CleanSession
+	s.mu.Unlock()
+	return s, present
+}
+
+// detach unbinds a closed connection, clean sessions are discarded.
+func (b *Broker) detach(s *session, c *client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != c {
+		return
+	}
+	s.client = nil
+	s.detached = time.Now()
+	if s.clean && b.sessions[s.id] == s {
+		delete(b.sessions, s.id)
+	}
+}
+
+// expireSessions discards the persistent sessions offline for longer than
+// the session expiry.
+func (b *Broker) expireSessions() {
+	expiry := time.Duration(b.conf.SessionExpirySec) * time.Second
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case now := <-ticker.C:
+			b.mu.Lock()
+			for id, s := range b.sessions {
+				s.mu.Lock()
+				if s.client == nil && now.Sub(s.detached) > expiry {
+					delete(b.sessions, id)
+					log.Printf("Broker: session %s expired", id)
+				}
+				s.mu.Unlock()
+			}
+			b.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func startBroker(t *testing.T, conf Config) (*Broker, string) {
+	t.Helper()
+	conf.Listeners = []Listener{{Addr: "127.0.0.1:0"}}
+	b := New(conf)
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	addr := b.listeners[0].Addr().String()
+	b.mu.Unlock()
+	return b, addr
+}
+
+// testClient speaks raw MQTT packets to the broker.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func connectPacket(id string) *packets.ConnectPacket {
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.ClientIdentifier = id
+	cp.CleanSession = true
+	return cp
+}
+
+// dial connects with cp and returns the client and its CONNACK.
+func dial(t *testing.T, addr string, cp *packets.ConnectPacket) (*testClient, *packets.ConnackPacket) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{t: t, conn: conn}
+	c.send(cp)
+	ack, ok := c.read().(*packets.ConnackPacket)
+	if !ok {
+		t.Fatal("no CONNACK")
+	}
+	return c, ack
+}
+
+// connect dials a client that must be accepted.
+func connect(t *testing.T, addr string, cp *packets.ConnectPacket) *testClient {
+	t.Helper()
+	c, ack := dial(t, addr, cp)
+	if ack.ReturnCode != packets.Accepted {
+		t.Fatalf("%s refused: %s", cp.ClientIdentifier, packets.ConnackReturnCodes[ack.ReturnCode])
+	}
+	return c
+}
+
+func (c *testClient) send(p packets.ControlPacket) {
+	c.t.Helper()
+	if err := p.Write(c.conn); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) read() packets.ControlPacket {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	p, err := packets.ReadPacket(c.conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return p
+}
+
+// readPublish reads the next packet, which must be a PUBLISH.
+func (c *testClient) readPublish() *packets.PublishPacket {
+	c.t.Helper()
+	p, ok := c.read().(*packets.PublishPacket)
+	if !ok {
+		c.t.Fatal("no PUBLISH")
+	}
+	return p
+}
+
+// closed tells whether the broker closed the connection.
+func (c *testClient) closed() bool {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := packets.ReadPacket(c.conn)
+	return err != nil
+}
+
+func (c *testClient) subscribe(filter string, qos byte) {
+	c.t.Helper()
+	p := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	p.MessageID = 1
+	p.Topics = []string{filter}
+	p.Qoss = []byte{qos}
+	c.send(p)
+	if _, ok := c.read().(*packets.SubackPacket); !ok {
+		c.t.Fatal("no SUBACK")
+	}
+}
+
+func (c *testClient) publish(topic, payload string, qos byte, id uint16, retain bool) {
+	c.t.Helper()
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = []byte(payload)
+	p.Qos = qos
+	p.MessageID = id
+	p.Retain = retain
+	c.send(p)
+}
+
+func (c *testClient) disconnect() {
+	c.send(packets.NewControlPacket(packets.Disconnect))
+	c.conn.Close()
+}
+
+func TestConnectAuthentication(t *testing.T) {
+	b, addr := startBroker(t, Config{Users: map[string]string{
+		"plain":  "secret",
+		"hashed": "sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b",
+	}})
+	defer b.Close()
+
+	for _, tc := range []struct {
+		user, password string
+		want           byte
+	}{
+		{"plain", "secret", packets.Accepted},
+		{"hashed", "secret", packets.Accepted},
+		{"plain", "wrong", packets.ErrRefusedBadUsernameOrPassword},
+		{"nobody", "secret", packets.ErrRefusedBadUsernameOrPassword},
+		{"", "", packets.ErrRefusedNotAuthorised},
+	} {
+		cp := connectPacket("auth")
+		if tc.user != "" {
+			cp.UsernameFlag, cp.Username = true, tc.user
+			cp.PasswordFlag, cp.Password = true, []byte(tc.password)
+		}
+		c, ack := dial(t, addr, cp)
+		if ack.ReturnCode != tc.want {
+			t.Errorf("%q/%q: %s, want %s", tc.user, tc.password,
+				packets.ConnackReturnCodes[ack.ReturnCode], packets.ConnackReturnCodes[tc.want])
+		}
+		if tc.want != packets.Accepted && !c.closed() {
+			t.Errorf("%q/%q: refused connection left open", tc.user, tc.password)
+		}
+		c.conn.Close()
+	}
+
+	if err := New(Config{Listeners: []Listener{{Addr: "127.0.0.1:0"}}}).Start(); err == nil {
+		t.Error("started without users nor anonymous access")
+	}
+}
+
+func TestQoS1(t *testing.T) {
+	b, addr := startBroker(t, Config{AllowAnonymous: true})
+	defer b.Close()
+	sub := connect(t, addr, connectPacket("sub"))
+	defer sub.conn.Close()
+	sub.subscribe("devs/+/temp", 1)
+	pub := connect(t, addr, connectPacket("pub"))
+	defer pub.conn.Close()
+
+	pub.publish("devs/gw-01/temp", "21.5", 1, 7, false)
+	if ack, ok := pub.read().(*packets.PubackPacket); !ok || ack.MessageID != 7 {
+		t.Fatalf("no PUBACK for 7")
+	}
+	p := sub.readPublish()
+	if p.TopicName != "devs/gw-01/temp" || string(p.Payload) != "21.5" || p.Qos != 1 || p.MessageID == 0 {
+		t.Errorf("delivered %s %q at qos %d id %d", p.TopicName, p.Payload, p.Qos, p.MessageID)
+	}
+	ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	ack.MessageID = p.MessageID
+	sub.send(ack)
+}
+
+func TestQoS2(t *testing.T) {
+	b, addr := startBroker(t, Config{AllowAnonymous: true})
+	defer b.Close()
+	routed := make(chan string, 10)
+	b.OnPublish = func(topic string, payload []byte, retained bool) {
+		routed <- string(payload)
+	}
+	pub := connect(t, addr, connectPacket("pub"))
+	defer pub.conn.Close()
+
+	// the duplicate before the PUBREL is acknowledged but not routed again
+	for i := 0; i < 2; i++ {
+		pub.publish("devs/gw-01/mode", "auto", 2, 9, false)
+		if rec, ok := pub.read().(*packets.PubrecPacket); !ok || rec.MessageID != 9 {
+			t.Fatalf("no PUBREC for 9")
+		}
+	}
+	rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	rel.MessageID = 9
+	pub.send(rel)
+	if comp, ok := pub.read().(*packets.PubcompPacket); !ok || comp.MessageID != 9 {
+		t.Fatalf("no PUBCOMP for 9")
+	}
+	// the id is free again once released
+	pub.publish("devs/gw-01/mode", "manual", 2, 9, false)
+	if _, ok := pub.read().(*packets.PubrecPacket); !ok {
+		t.Fatal("no PUBREC")
+	}
+
+	for _, want := range []string{"auto", "manual"} {
+		select {
+		case got := <-routed:
+			if got != want {
+				t.Errorf("routed %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%q not routed", want)
+		}
+	}
+	select {
+	case got := <-routed:
+		t.Errorf("%q routed twice", got)
+	default:
+	}
+}
+
+func TestRetainedOnSubscribe(t *testing.T) {
+	b, addr := startBroker(t, Config{AllowAnonymous: true})
+	defer b.Close()
+	pub := connect(t, addr, connectPacket("pub"))
+	defer pub.conn.Close()
+	pub.publish("devs/gw-01/status", `{"value":1}`, 1, 1, true)
+	pub.read()
+	pub.publish("devs/gw-02/status", `{"value":1}`, 1, 2, true)
+	pub.read()
+	// an empty retained message clears the topic
+	pub.publish("devs/gw-02/status", "", 1, 3, true)
+	pub.read()
+
+	sub := connect(t, addr, connectPacket("sub"))
+	defer sub.conn.Close()
+	sub.subscribe("devs/+/status", 0)
+	p := sub.readPublish()
+	if p.TopicName != "devs/gw-01/status" || !p.Retain || p.Qos != 0 {
+		t.Errorf("delivered %s retain %v qos %d", p.TopicName, p.Retain, p.Qos)
+	}
+	if st := b.Stats(); st.Retained != 1 {
+		t.Errorf("%d retained messages, want 1", st.Retained)
+	}
+}
+
+func TestLastWill(t *testing.T) {
+	b, addr := startBroker(t, Config{AllowAnonymous: true})
+	defer b.Close()
+	sub := connect(t, addr, connectPacket("sub"))
+	defer sub.conn.Close()
+	sub.subscribe("devs/+/status", 0)
+
+	for device, abrupt := range map[string]bool{"gw-01": false, "gw-02": true} {
+		cp := connectPacket(device)
+		cp.WillFlag = true
+		cp.WillTopic = "devs/" + device + "/status"
+		cp.WillMessage = []byte(`{"value":0}`)
+		c := connect(t, addr, cp)
+		if abrupt {
+			c.conn.Close()
+		} else {
+			c.disconnect()
+		}
+	}
+	// only the abrupt close publishes the will
+	p := sub.readPublish()
+	if p.TopicName != "devs/gw-02/status" || string(p.Payload) != `{"value":0}` {
+		t.Errorf("will %s %q", p.TopicName, p.Payload)
+	}
+	sub.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := packets.ReadPacket(sub.conn); err == nil {
+		t.Error("will published after a DISCONNECT")
+	}
+}
+
+func TestACL(t *testing.T) {
+	b, addr := startBroker(t, Config{
+		Users: map[string]string{"gw-01": "p", "cloud": "p"},
+		ACL: []ACLRule{
+			{User: "*", Topic: "devs/%u/#", Access: accessWrite},
+			{User: "cloud", Topic: "devs/#", Access: accessRead},
+		},
+	})
+	defer b.Close()
+	login := func(id string) *packets.ConnectPacket {
+		cp := connectPacket(id)
+		cp.UsernameFlag, cp.Username = true, id
+		cp.PasswordFlag, cp.Password = true, []byte("p")
+		return cp
+	}
+	cloud := connect(t, addr, login("cloud"))
+	defer cloud.conn.Close()
+	cloud.subscribe("devs/#", 0)
+	gw := connect(t, addr, login("gw-01"))
+	defer gw.conn.Close()
+	gw.subscribe("devs/#", 0)
+
+	// gw-01 may not write for another device, and reads nothing
+	gw.publish("devs/gw-02/temp", "1", 0, 0, false)
+	gw.publish("devs/gw-01/temp", "2", 0, 0, false)
+	p := cloud.readPublish()
+	if p.TopicName != "devs/gw-01/temp" {
+		t.Errorf("cloud received %s", p.TopicName)
+	}
+	gw.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := packets.ReadPacket(gw.conn); err == nil {
+		t.Error("gw-01 read without the read access")
+	}
+}
+
+func TestPersistentSession(t *testing.T) {
+	b, addr := startBroker(t, Config{AllowAnonymous: true})
+	defer b.Close()
+	cp := connectPacket("cloud")
+	cp.CleanSession = false
+	c := connect(t, addr, cp)
+	c.subscribe("devs/#", 1)
+	c.disconnect()
+
+	// wait for the broker to detach the connection
+	for i := 0; b.Stats().ClientsConnected > 0; i++ {
+		if i == 100 {
+			t.Fatal("client still connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.Publish("devs/gw-01/temp", []byte("1"), 1, false)
+	b.Publish("devs/gw-01/temp", []byte("2"), 0, false)
+
+	c, ack := dial(t, addr, cp)
+	if !ack.SessionPresent {
+		t.Fatal("session not resumed")
+	}
+	p := c.readPublish()
+	if string(p.Payload) != "1" || p.Qos != 1 {
+		t.Errorf("resumed with %q at qos %d, only the QoS 1 message is queued", p.Payload, p.Qos)
+	}
+	c.disconnect()
+
+	// a clean session discards the persistent one
+	cp.CleanSession = true
+	c, ack = dial(t, addr, cp)
+	defer c.conn.Close()
+	if ack.SessionPresent {
+		t.Error("clean session resumed the persistent one")
+	}
+	if st := b.Stats(); st.Subscriptions != 0 {
+		t.Errorf("%d subscriptions kept by a clean session", st.Subscriptions)
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	b, addr := startBroker(t, Config{AllowAnonymous: true})
+	defer b.Close()
+	for _, clean := range []bool{false, true} {
+		cp := connectPacket("gw-01")
+		cp.CleanSession = clean
+		first := connect(t, addr, cp)
+		first.subscribe("devs/#", 0)
+		second := connect(t, addr, cp)
+		if !first.closed() {
+			t.Errorf("clean %v: first connection not closed", clean)
+		}
+		// the second connection owns the session
+		second.subscribe("devs/#", 0)
+		b.Publish("devs/gw-01/temp", []byte("1"), 0, false)
+		if p := second.readPublish(); string(p.Payload) != "1" {
+			t.Errorf("clean %v: received %q", clean, p.Payload)
+		}
+		second.disconnect()
+		first.conn.Close()
+	}
+}
@@ -0,0 +1,383 @@
+package broker
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const (
+	connectTimeout = 10 * time.Second
+	writeTimeout   = 10 * time.Second
+)
+
+// client is one network connection, packets are written by its own
+// goroutine so that a slow client does not block the publishers.
+type client struct {
+	conn      net.Conn
+	out       chan packets.ControlPacket
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newClient(conn net.Conn, queue int) *client {
+	return &client{
+		conn: conn,
+		out:  make(chan packets.ControlPacket, queue),
+		done: make(chan struct{}),
+	}
+}
+
+// send queues a packet, a client not keeping up is disconnected.
+func (c *client) send(p packets.ControlPacket) bool {
+	select {
+	case c.out <- p:
+		return true
+	case <-c.done:
+		return false
+	default:
+		log.Printf("Broker: client %s too slow, disconnecting", c.conn.RemoteAddr())
+		c.close()
+		return false
+	}
+}
+
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *client) writeLoop() {
+	for {
+		select {
+		case p := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := p.Write(c.conn); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// session is the state of a client id, kept across connections when the
+// client asked for a persistent session.
+type session struct {
+	broker *Broker
+	id     string
+
+	mu       sync.Mutex
+	user     string
+	clean    bool
+	client   *client
+	subs     map[string]byte
+	inflight map[uint16]*message
+	queue    []*message
+	nextID   uint16
+	// received are the ids of the QoS 2 publishes awaiting their PUBREL
+	received map[uint16]bool
+	// detached is when the last connection closed
+	detached time.Time
+}
+
+func newSession(b *Broker, id string) *session {
+	return &session{
+		broker:   b,
+		id:       id,
+		subs:     map[string]byte{},
+		inflight: map[uint16]*message{},
+		received: map[uint16]bool{},
+	}
+}
+
+func (s *session) connection() *client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client
+}
+
+// takeover binds c to the session and returns the connection it replaces.
+func (s *session) takeover(c *client) *client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.client
+	s.client = c
+	return old
+}
+
+// subscribed returns the highest qos of the subscriptions matching topic.
+func (s *session) subscribed(topic string) (byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	qos, found := byte(0), false
+	for filter, q := range s.subs {
+		if Match(filter, topic) {
+			if !found || q > qos {
+				qos = q
+			}
+			found = true
+		}
+	}
+	return qos, found
+}
+
+// deliver sends m at qos, QoS 1 messages are queued while the client is
+// offline.
+func (s *session) deliver(m *message, qos byte, retain bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.broker.allowed(s.user, s.id, m.topic, accessRead) {
+		return
+	}
+	if qos == 0 {
+		if s.client != nil && s.client.send(publishPacket(m, 0, 0, retain, false)) {
+			s.broker.sentMessage(m)
+		}
+		return
+	}
+	if s.client == nil {
+		if s.clean {
+			return
+		}
+		if len(s.queue) >= s.broker.conf.MaxQueued {
+			s.queue = s.queue[1:]
+		}
+		s.queue = append(s.queue, m)
+		return
+	}
+	if len(s.inflight) >= s.broker.conf.MaxQueued {
+		log.Printf("Broker: too many unacknowledged messages for %s, dropping %s", s.id, m.topic)
+		return
+	}
+	id := s.messageID()
+	s.inflight[id] = m
+	if s.client.send(publishPacket(m, 1, id, retain, false)) {
+		s.broker.sentMessage(m)
+	}
+}
+
+// resume resends the unacknowledged and queued messages of a persistent
+// session.
+func (s *session) resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, m := range s.inflight {
+		s.client.send(publishPacket(m, 1, id, false, true))
+	}
+	queue := s.queue
+	s.queue = nil
+	for _, m := range queue {
+		id := s.messageID()
+		s.inflight[id] = m
+		if s.client.send(publishPacket(m, 1, id, false, false)) {
+			s.broker.sentMessage(m)
+		}
+	}
+}
+
+// messageID returns the next free packet identifier, the caller holds the
+// lock.
+func (s *session) messageID() uint16 {
+	for {
+		s.nextID++
+		if s.nextID == 0 {
+			continue
+		}
+		if _, used := s.inflight[s.nextID]; !used {
+			return s.nextID
+		}
+	}
+}
+
+func publishPacket(m *message, qos byte, id uint16, retain, dup bool) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = m.topic
+	p.Payload = m.payload
+	p.Qos = qos
+	p.MessageID = id
+	p.Retain = retain
+	p.Dup = dup
+	return p
+}
+
+// serve runs the MQTT session of one connection.
+func (b *Broker) serve(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := packets.ReadPacket(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	cp, ok := p.(*packets.ConnectPacket)
+	if !ok {
+		log.Printf("Broker: %s did not start with CONNECT", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = cp.Validate()
+	if connack.ReturnCode == packets.Accepted {
+		connack.ReturnCode = b.authenticate(cp)
+	}
+	if connack.ReturnCode != packets.Accepted {
+		log.Printf("Broker: refused %s from %s: %s", cp.ClientIdentifier, conn.RemoteAddr(), packets.ConnackReturnCodes[connack.ReturnCode])
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		connack.Write(conn)
+		conn.Close()
+		return
+	}
+
+	c := newClient(conn, b.conf.MaxQueued)
+	go c.writeLoop()
+	s, present := b.attach(cp, connack, c)
+	var will *message
+	if cp.WillFlag {
+		will = &message{topic: cp.WillTopic, payload: cp.WillMessage, qos: cp.WillQos, retain: cp.WillRetain}
+		if will.qos > 1 {
+			will.qos = 1
+		}
+	}
+	if present {
+		s.resume()
+	}
+
+	keepalive := time.Duration(cp.Keepalive) * time.Second * 3 / 2
+	graceful := false
+	for !graceful {
+		if keepalive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepalive))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			break
+		}
+		switch p := p.(type) {
+		case *packets.PublishPacket:
+			b.handlePublish(s, c, p)
+		case *packets.PubackPacket:
+			s.mu.Lock()
+			delete(s.inflight, p.MessageID)
+			s.mu.Unlock()
+		case *packets.PubrelPacket:
+			s.mu.Lock()
+			delete(s.received, p.MessageID)
+			s.mu.Unlock()
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			c.send(comp)
+		case *packets.SubscribePacket:
+			b.subscribe(s, c, p)
+		case *packets.UnsubscribePacket:
+			s.mu.Lock()
+			for _, topic := range p.Topics {
+				delete(s.subs, topic)
+			}
+			s.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			c.send(ack)
+		case *packets.PingreqPacket:
+			c.send(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			graceful = true
+		default:
+			log.Printf("Broker: unexpected %s from %s", p.String(), s.id)
+			c.close()
+		}
+	}
+
+	c.close()
+	b.detach(s, c)
+	if !graceful && will != nil && b.allowed(s.user, s.id, will.topic, accessWrite) && validTopic(will.topic) {
+		b.publish(will)
+	}
+}
+
+// handlePublish handles a PUBLISH from a client.
+func (b *Broker) handlePublish(s *session, c *client, p *packets.PublishPacket) {
+	switch p.Qos {
+	case 1:
+		ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		ack.MessageID = p.MessageID
+		c.send(ack)
+	case 2:
+		// a QoS 2 publish is routed once, until its PUBREL frees the id
+		s.mu.Lock()
+		routed := s.received[p.MessageID]
+		full := !routed && len(s.received) >= b.conf.MaxQueued
+		if !routed && !full {
+			s.received[p.MessageID] = true
+		}
+		s.mu.Unlock()
+		if full {
+			log.Printf("Broker: too many unreleased QoS 2 messages from %s, disconnecting", s.id)
+			c.close()
+			return
+		}
+		rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		rec.MessageID = p.MessageID
+		c.send(rec)
+		if routed {
+			return
+		}
+	}
+	if !validTopic(p.TopicName) {
+		log.Printf("Broker: invalid topic %q from %s", p.TopicName, s.id)
+		c.close()
+		return
+	}
+	s.mu.Lock()
+	user := s.user
+	s.mu.Unlock()
+	if !b.allowed(user, s.id, p.TopicName, accessWrite) {
+		log.Printf("Broker: %s not allowed to publish on %s", s.id, p.TopicName)
+		return
+	}
+	qos := p.Qos
+	if qos > 1 {
+		qos = 1
+	}
+	b.publish(&message{topic: p.TopicName, payload: p.Payload, qos: qos, retain: p.Retain})
+}
+
+// subscribe adds the subscriptions and sends the matching retained messages.
+func (b *Broker) subscribe(s *session, c *client, p *packets.SubscribePacket) {
+	ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	ack.MessageID = p.MessageID
+	granted := map[string]byte{}
+	s.mu.Lock()
+	for i, filter := range p.Topics {
+		if !validFilter(filter) {
+			ack.ReturnCodes = append(ack.ReturnCodes, 0x80)
+			continue
+		}
+		qos := p.Qoss[i]
+		if qos > 1 {
+			qos = 1
+		}
+		s.subs[filter] = qos
+		granted[filter] = qos
+		ack.ReturnCodes = append(ack.ReturnCodes, qos)
+	}
+	s.mu.Unlock()
+	c.send(ack)
+
+	for filter, qos := range granted {
+		for _, m := range b.retainedFor(filter) {
+			q := qos
+			if q > m.qos {
+				q = m.qos
+			}
+			s.deliver(m, q, true)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package protowire holds the protobuf wire format helpers shared by the
+// hand written codecs of the Sparkplug payloads and the remote_write
+// requests.
+package protowire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Wire types.
+const (
+	Varint  = 0
+	Fixed64 = 1
+	Bytes   = 2
+	Fixed32 = 5
+)
+
+// ErrTruncated is returned when a message ends within a field.
+var ErrTruncated = errors.New("truncated message")
+
+// Encoder appends fields to Buf.
+type Encoder struct {
+	Buf []byte
+}
+
+func (e *Encoder) varint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	e.Buf = append(e.Buf, tmp[:n]...)
+}
+
+func (e *Encoder) key(field, wire int) {
+	e.varint(uint64(field<<3 | wire))
+}
+
+// Uint appends a varint field.
+func (e *Encoder) Uint(field int, v uint64) {
+	e.key(field, Varint)
+	e.varint(v)
+}
+
+// Fixed32 appends a 32-bit field.
+func (e *Encoder) Fixed32(field int, v uint32) {
+	e.key(field, Fixed32)
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], v)
+	e.Buf = append(e.Buf, tmp[:]...)
+}
+
+// Fixed64 appends a 64-bit field.
+func (e *Encoder) Fixed64(field int, v uint64) {
+	e.key(field, Fixed64)
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	e.Buf = append(e.Buf, tmp[:]...)
+}
+
+// Bytes appends a length-delimited field.
+func (e *Encoder) Bytes(field int, b []byte) {
+	e.key(field, Bytes)
+	e.varint(uint64(len(b)))
+	e.Buf = append(e.Buf, b...)
+}
+
+// Decoder reads the fields of a message.
+type Decoder struct {
+	buf []byte
+	pos int
+}
+
+// NewDecoder returns a decoder of b.
+func NewDecoder(b []byte) *Decoder {
+	return &Decoder{buf: b}
+}
+
+// Done reports whether the whole message was read.
+func (d *Decoder) Done() bool {
+	return d.pos >= len(d.buf)
+}
+
+// Key reads the field number and wire type of the next field.
+func (d *Decoder) Key() (int, int, error) {
+	v, err := d.Varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(v >> 3), int(v & 7), nil
+}
+
+// Varint reads a varint value.
+func (d *Decoder) Varint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf[d.pos:])
+	if n <= 0 {
+		return 0, ErrTruncated
+	}
+	d.pos += n
+	return v, nil
+}
+
+// Fixed32 reads a 32-bit value.
+func (d *Decoder) Fixed32() (uint32, error) {
+	if len(d.buf)-d.pos < 4 {
+		return 0, ErrTruncated
+	}
+	v := binary.LittleEndian.Uint32(d.buf[d.pos:])
+	d.pos += 4
+	return v, nil
+}
+
+// Fixed64 reads a 64-bit value.
+func (d *Decoder) Fixed64() (uint64, error) {
+	if len(d.buf)-d.pos < 8 {
+		return 0, ErrTruncated
+	}
+	v := binary.LittleEndian.Uint64(d.buf[d.pos:])
+	d.pos += 8
+	return v, nil
+}
+
+// Bytes reads a length-delimited value, it shares the memory of the
+// message.
+func (d *Decoder) Bytes() ([]byte, error) {
+	l, err := d.Varint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(d.buf)-d.pos) < l {
+		return nil, ErrTruncated
+	}
+	b := d.buf[d.pos : d.pos+int(l)]
+	d.pos += int(l)
+	return b, nil
+}
+
+// Skip reads past the value of a field of an unknown or unexpected type.
+func (d *Decoder) Skip(wire int) error {
+	var err error
+	switch wire {
+	case Varint:
+		_, err = d.Varint()
+	case Fixed64:
+		_, err = d.Fixed64()
+	case Bytes:
+		_, err = d.Bytes()
+	case Fixed32:
+		_, err = d.Fixed32()
+	default:
+		err = fmt.Errorf("unsupported wire type %d", wire)
+	}
+	return err
+}
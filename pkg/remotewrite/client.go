@@ -0,0 +1,426 @@
+// Package remotewrite pushes samples to a Prometheus remote_write
+// endpoint. Series are spread over shards that batch and send them
+// concurrently, a series always goes through the same shard so its samples
+// stay in order. Failed sends are retried with backoff, and while the
+// shards are backed up the samples are spilled to a write-ahead log on disk
+// and replayed once the endpoint catches up.
+package remotewrite
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultShards              = 4
+	defaultCapacity            = 2500
+	defaultMaxSamplesPerSend   = 500
+	defaultBatchSendDeadlineMs = 1000
+	defaultMinBackoffMs        = 30
+	defaultMaxBackoffMs        = 5000
+	defaultTimeoutSec          = 30
+	defaultWALMaxSizeMB        = 512
+)
+
+// Config of a remote_write client.
+type Config struct {
+	URL string `json:"url"`
+	// Username and Password authenticate with basic auth, BearerToken
+	// with a bearer token.
+	Username    string            `json:"username"`
+	Password    string            `json:"password"`
+	BearerToken string            `json:"bearerToken"`
+	Headers     map[string]string `json:"headers"`
+	// ExternalLabels are added to every series.
+	ExternalLabels map[string]string `json:"externalLabels"`
+
+	Shards int `json:"shards"`
+	// Capacity bounds the series queued per shard, the samples are spilled
+	// to the wal once a shard is full.
+	Capacity            int `json:"capacity"`
+	MaxSamplesPerSend   int `json:"maxSamplesPerSend"`
+	BatchSendDeadlineMs int `json:"batchSendDeadlineMs"`
+	MinBackoffMs        int `json:"minBackoffMs"`
+	MaxBackoffMs        int `json:"maxBackoffMs"`
+	TimeoutSec          int `json:"timeoutSec"`
+
+	// WALDir is where samples are spilled during outages, they are dropped
+	// without one. The oldest samples are dropped past WALMaxSizeMB.
+	WALDir       string `json:"walDir"`
+	WALMaxSizeMB int    `json:"walMaxSizeMB"`
+}
+
+// Stats are the client counters since it started.
+type Stats struct {
+	SamplesSent    uint64
+	SamplesDropped uint64
+	SamplesSpilled uint64
+	Retries        uint64
+	Pending        int
+	WALBytes       int64
+}
+
+// recoverableError is a failed send worth retrying.
+type recoverableError struct {
+	error
+}
+
+// Client sends samples to a remote_write endpoint.
+type Client struct {
+	// the counters are first to stay 64-bit aligned for atomic access on
+	// 32-bit platforms
+	sent    uint64
+	dropped uint64
+	spilled uint64
+	retries uint64
+
+	conf       Config
+	httpClient *http.Client
+	external   []Label
+	shards     []*shard
+
+	// mu guards the wal, spilling is set while samples go to the wal
+	mu       sync.Mutex
+	wal      *wal
+	spilling bool
+	replay   chan struct{}
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type shard struct {
+	queue chan TimeSeries
+}
+
+// New returns a client, samples left in the wal by a previous run are
+// replayed once it starts.
+func New(conf Config) (*Client, error) {
+	if conf.URL == "" {
+		return nil, fmt.Errorf("remotewrite: url is required")
+	}
+	if conf.Shards <= 0 {
+		conf.Shards = defaultShards
+	}
+	if conf.Capacity <= 0 {
+		conf.Capacity = defaultCapacity
+	}
+	if conf.MaxSamplesPerSend <= 0 {
+		conf.MaxSamplesPerSend = defaultMaxSamplesPerSend
+	}
+	if conf.BatchSendDeadlineMs <= 0 {
+		conf.BatchSendDeadlineMs = defaultBatchSendDeadlineMs
+	}
+	if conf.MinBackoffMs <= 0 {
+		conf.MinBackoffMs = defaultMinBackoffMs
+	}
+	if conf.MaxBackoffMs < conf.MinBackoffMs {
+		conf.MaxBackoffMs = defaultMaxBackoffMs
+	}
+	if conf.TimeoutSec <= 0 {
+		conf.TimeoutSec = defaultTimeoutSec
+	}
+	if conf.WALMaxSizeMB <= 0 {
+		conf.WALMaxSizeMB = defaultWALMaxSizeMB
+	}
+
+	c := &Client{
+		conf:       conf,
+		httpClient: &http.Client{Timeout: time.Duration(conf.TimeoutSec) * time.Second},
+		replay:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	for name, value := range conf.ExternalLabels {
+		c.external = append(c.external, Label{Name: name, Value: value})
+	}
+	for i := 0; i < conf.Shards; i++ {
+		c.shards = append(c.shards, &shard{queue: make(chan TimeSeries, conf.Capacity)})
+	}
+	if conf.WALDir != "" {
+		// a segment is always kept, the limit cannot be below two of them
+		maxSize := int64(conf.WALMaxSizeMB) << 20
+		if maxSize < 2*walSegmentSize {
+			maxSize = 2 * walSegmentSize
+		}
+		w, err := openWAL(conf.WALDir, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("remotewrite: %s", err)
+		}
+		c.wal = w
+		if !w.Empty() {
+			c.spilling = true
+			c.replay <- struct{}{}
+		}
+	}
+	return c, nil
+}
+
+// Start runs the shards and the wal replay in the background.
+func (c *Client) Start() {
+	for _, s := range c.shards {
+		c.wg.Add(1)
+		go c.run(s)
+	}
+	if c.wal != nil {
+		c.wg.Add(1)
+		go c.replayWAL()
+	}
+}
+
+// Close stops the client, the queued samples not spilled to the wal are
+// lost.
+func (c *Client) Close() error {
+	close(c.done)
+	c.wg.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.wal != nil {
+		return c.wal.Close()
+	}
+	return nil
+}
+
+// Append queues a series, its labels are sorted and the external labels
+// added. It never blocks: when the shard of the series is full the series
+// is spilled to the wal, or dropped without one.
+func (c *Client) Append(ts TimeSeries) {
+	if len(c.external) > 0 {
+		ts.Labels = append(append([]Label{}, ts.Labels...), c.external...)
+	}
+	sort.SliceStable(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.spilling {
+		select {
+		case c.shardOf(ts).queue <- ts:
+			return
+		default:
+		}
+		if c.wal == nil {
+			atomic.AddUint64(&c.dropped, uint64(len(ts.Samples)))
+			return
+		}
+		// everything goes through the wal from now on so that a series
+		// already spilled is not overtaken by its later samples
+		log.Printf("Remote write is backed up, spilling samples to %s", c.conf.WALDir)
+		c.spilling = true
+		select {
+		case c.replay <- struct{}{}:
+		default:
+		}
+	}
+	dropped, err := c.wal.Append(&ts)
+	if err != nil {
+		log.Printf("Remote write dropped %d samples, wal failed: %s", len(ts.Samples), err)
+		atomic.AddUint64(&c.dropped, uint64(len(ts.Samples)))
+		return
+	}
+	atomic.AddUint64(&c.spilled, uint64(len(ts.Samples)))
+	atomic.AddUint64(&c.dropped, uint64(dropped))
+}
+
+// Stats returns the client counters.
+func (c *Client) Stats() Stats {
+	s := Stats{
+		SamplesSent:    atomic.LoadUint64(&c.sent),
+		SamplesDropped: atomic.LoadUint64(&c.dropped),
+		SamplesSpilled: atomic.LoadUint64(&c.spilled),
+		Retries:        atomic.LoadUint64(&c.retries),
+	}
+	for _, sh := range c.shards {
+		s.Pending += len(sh.queue)
+	}
+	c.mu.Lock()
+	if c.wal != nil {
+		s.WALBytes = c.wal.size
+	}
+	c.mu.Unlock()
+	return s
+}
+
+func (c *Client) shardOf(ts TimeSeries) *shard {
+	h := fnv.New32a()
+	for _, l := range ts.Labels {
+		h.Write([]byte(l.Name))
+		h.Write([]byte{0xff})
+		h.Write([]byte(l.Value))
+		h.Write([]byte{0xff})
+	}
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+// replayWAL drains the wal segment by segment into the shards, blocking
+// while they are full, and stops spilling once it is empty.
+func (c *Client) replayWAL() {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.replay:
+		}
+		for {
+			c.mu.Lock()
+			if c.wal.Empty() {
+				c.spilling = false
+				c.mu.Unlock()
+				log.Printf("Remote write caught up with the wal")
+				break
+			}
+			segment, ok, err := c.wal.Next()
+			c.mu.Unlock()
+			if err != nil || !ok {
+				log.Printf("Remote write failed to read the wal: %v", err)
+				c.sleep(time.Second)
+				continue
+			}
+
+			err = c.wal.Read(segment, func(ts TimeSeries) {
+				select {
+				case c.shardOf(ts).queue <- ts:
+				case <-c.done:
+				}
+			})
+			select {
+			case <-c.done:
+				// keep the segment, its samples are replayed on restart
+				return
+			default:
+			}
+			if err != nil {
+				log.Printf("Remote write skipped the rest of wal segment %d: %s", segment, err)
+			}
+			c.mu.Lock()
+			err = c.wal.Remove(segment)
+			c.mu.Unlock()
+			if err != nil {
+				log.Printf("Remote write failed to remove wal segment %d: %s", segment, err)
+			}
+		}
+	}
+}
+
+// run batches the series of a shard, a batch is sent once full or when
+// the oldest series waited for the send deadline.
+func (c *Client) run(s *shard) {
+	defer c.wg.Done()
+	deadline := time.Duration(c.conf.BatchSendDeadlineMs) * time.Millisecond
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+	batch := make([]TimeSeries, 0, c.conf.MaxSamplesPerSend)
+	samples := 0
+	for {
+		select {
+		case <-c.done:
+			return
+		case ts := <-s.queue:
+			batch = append(batch, ts)
+			samples += len(ts.Samples)
+			if samples < c.conf.MaxSamplesPerSend {
+				continue
+			}
+		case <-timer.C:
+			timer.Reset(deadline)
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		c.send(batch, samples)
+		batch = make([]TimeSeries, 0, c.conf.MaxSamplesPerSend)
+		samples = 0
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(deadline)
+	}
+}
+
+// send delivers a batch, retrying recoverable failures until it succeeds
+// or the client is closed.
+func (c *Client) send(batch []TimeSeries, samples int) {
+	req := &WriteRequest{Timeseries: batch}
+	body := snappyEncode(req.Marshal())
+	backoff := time.Duration(c.conf.MinBackoffMs) * time.Millisecond
+	maxBackoff := time.Duration(c.conf.MaxBackoffMs) * time.Millisecond
+	for {
+		err := c.post(body)
+		if err == nil {
+			atomic.AddUint64(&c.sent, uint64(samples))
+			return
+		}
+		if _, ok := err.(recoverableError); !ok {
+			log.Printf("Remote write dropped %d samples: %s", samples, err)
+			atomic.AddUint64(&c.dropped, uint64(samples))
+			return
+		}
+		atomic.AddUint64(&c.retries, 1)
+		if !c.sleep(backoff) {
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// post sends an encoded request, server errors, throttling and network
+// failures are recoverable.
+func (c *Client) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, c.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "mqtt-exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range c.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	switch {
+	case c.conf.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.conf.BearerToken)
+	case c.conf.Username != "":
+		req.SetBasicAuth(c.conf.Username, c.conf.Password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return recoverableError{err}
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return recoverableError{err}
+	}
+	return err
+}
+
+// sleep waits for d, it returns false when the client is closed meanwhile.
+func (c *Client) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
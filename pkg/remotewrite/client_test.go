@@ -0,0 +1,157 @@
+package remotewrite
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// endpoint is a remote_write test server answering with the queued status
+// codes, then with status once they are exhausted.
+type endpoint struct {
+	t        *testing.T
+	mu       sync.Mutex
+	statuses []int
+	status   int
+	requests int
+	received []TimeSeries
+}
+
+func (e *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests++
+	if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		e.t.Errorf("request headers %v", r.Header)
+	}
+	status := e.status
+	if len(e.statuses) > 0 {
+		status, e.statuses = e.statuses[0], e.statuses[1:]
+	}
+	if status/100 == 2 {
+		data, err := snappy.Decode(nil, body)
+		if err != nil {
+			e.t.Errorf("snappy: %s", err)
+		}
+		req, err := unmarshalWriteRequest(data)
+		if err != nil {
+			e.t.Errorf("protobuf: %s", err)
+		}
+		e.received = append(e.received, req.Timeseries...)
+	}
+	w.WriteHeader(status)
+}
+
+func (e *endpoint) setStatus(status int) {
+	e.mu.Lock()
+	e.status = status
+	e.mu.Unlock()
+}
+
+// waitFor polls cond for a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testConfig(url string) Config {
+	return Config{
+		URL:                 url,
+		Shards:              1,
+		MaxSamplesPerSend:   1,
+		BatchSendDeadlineMs: 10,
+		MinBackoffMs:        1,
+		MaxBackoffMs:        2,
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	e := &endpoint{t: t, status: http.StatusNoContent, statuses: []int{
+		http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusNoContent,
+		http.StatusBadRequest,
+	}}
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	c, err := New(testConfig(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Close()
+
+	// the 5xx and the 429 are retried until the sample is accepted
+	c.Append(testSeries(0))
+	waitFor(t, "the first sample", func() bool { return c.Stats().SamplesSent == 1 })
+	if st := c.Stats(); st.Retries != 2 {
+		t.Errorf("%d retries, want 2", st.Retries)
+	}
+	// the 400 drops the sample without a retry
+	c.Append(testSeries(1))
+	waitFor(t, "the second sample", func() bool { return c.Stats().SamplesDropped == 1 })
+	c.Append(testSeries(2))
+	waitFor(t, "the third sample", func() bool { return c.Stats().SamplesSent == 2 })
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.requests != 5 {
+		t.Errorf("%d requests, want 5", e.requests)
+	}
+	if len(e.received) != 2 || e.received[0].Samples[0].Value != 0 || e.received[1].Samples[0].Value != 2 {
+		t.Errorf("received %+v", e.received)
+	}
+}
+
+func TestClientSpillsToWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	e := &endpoint{t: t, status: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	conf := testConfig(srv.URL)
+	conf.Capacity = 1
+	conf.WALDir = dir
+	c, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Close()
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		c.Append(testSeries(i))
+	}
+	if st := c.Stats(); st.SamplesSpilled == 0 || st.WALBytes == 0 {
+		t.Fatalf("nothing spilled while the endpoint is down: %+v", st)
+	}
+
+	// the wal is replayed in order and removed once the endpoint is back
+	e.setStatus(http.StatusNoContent)
+	waitFor(t, "the replay", func() bool { return c.Stats().SamplesSent == n })
+	waitFor(t, "the wal removal", func() bool { return c.Stats().WALBytes == 0 && len(walFiles(t, dir)) == 0 })
+	if st := c.Stats(); st.SamplesDropped != 0 {
+		t.Errorf("%d samples dropped", st.SamplesDropped)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, ts := range e.received {
+		if ts.Samples[0].Timestamp != int64(i) {
+			t.Fatalf("sample %d received at position %d", ts.Samples[0].Timestamp, i)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package remotewrite
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/MOXA-ISD/edge-ha/pkg/internal/protowire"
+)
+
+// Label is a label of a series, the metric name is the "__name__" label.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value at a timestamp in milliseconds since the epoch.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// TimeSeries is a series and its samples.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// WriteRequest is the body of a remote_write request.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+// Marshal encodes the request in protobuf wire format.
+func (r *WriteRequest) Marshal() []byte {
+	e := &protowire.Encoder{}
+	for i := range r.Timeseries {
+		e.Bytes(1, r.Timeseries[i].Marshal())
+	}
+	return e.Buf
+}
+
+// Marshal encodes the series in protobuf wire format.
+func (ts *TimeSeries) Marshal() []byte {
+	e := &protowire.Encoder{}
+	for _, l := range ts.Labels {
+		le := &protowire.Encoder{}
+		le.Bytes(1, []byte(l.Name))
+		le.Bytes(2, []byte(l.Value))
+		e.Bytes(1, le.Buf)
+	}
+	for _, s := range ts.Samples {
+		se := &protowire.Encoder{}
+		se.Fixed64(1, math.Float64bits(s.Value))
+		se.Uint(2, uint64(s.Timestamp))
+		e.Bytes(2, se.Buf)
+	}
+	return e.Buf
+}
+
+// UnmarshalTimeSeries decodes a series encoded by Marshal.
+func UnmarshalTimeSeries(b []byte) (TimeSeries, error) {
+	ts, err := unmarshalTimeSeries(b)
+	if err != nil {
+		return ts, fmt.Errorf("remotewrite: %s", err)
+	}
+	return ts, nil
+}
+
+func unmarshalTimeSeries(b []byte) (TimeSeries, error) {
+	ts := TimeSeries{}
+	d := protowire.NewDecoder(b)
+	for !d.Done() {
+		field, wire, err := d.Key()
+		if err != nil {
+			return ts, err
+		}
+		if wire != protowire.Bytes {
+			if err := d.Skip(wire); err != nil {
+				return ts, err
+			}
+			continue
+		}
+		b, err := d.Bytes()
+		if err != nil {
+			return ts, err
+		}
+		switch field {
+		case 1:
+			l, err := unmarshalLabel(b)
+			if err != nil {
+				return ts, err
+			}
+			ts.Labels = append(ts.Labels, l)
+		case 2:
+			s, err := unmarshalSample(b)
+			if err != nil {
+				return ts, err
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+	}
+	return ts, nil
+}
+
+func unmarshalLabel(b []byte) (Label, error) {
+	l := Label{}
+	d := protowire.NewDecoder(b)
+	for !d.Done() {
+		field, wire, err := d.Key()
+		if err != nil {
+			return l, err
+		}
+		if wire != protowire.Bytes {
+			if err := d.Skip(wire); err != nil {
+				return l, err
+			}
+			continue
+		}
+		v, err := d.Bytes()
+		if err != nil {
+			return l, err
+		}
+		switch field {
+		case 1:
+			l.Name = string(v)
+		case 2:
+			l.Value = string(v)
+		}
+	}
+	return l, nil
+}
+
+func unmarshalSample(b []byte) (Sample, error) {
+	s := Sample{}
+	d := protowire.NewDecoder(b)
+	for !d.Done() {
+		field, wire, err := d.Key()
+		if err != nil {
+			return s, err
+		}
+		switch {
+		case field == 1 && wire == protowire.Fixed64:
+			v, err := d.Fixed64()
+			if err != nil {
+				return s, err
+			}
+			s.Value = math.Float64frombits(v)
+		case field == 2 && wire == protowire.Varint:
+			v, err := d.Varint()
+			if err != nil {
+				return s, err
+			}
+			s.Timestamp = int64(v)
+		default:
+			if err := d.Skip(wire); err != nil {
+				return s, err
+			}
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,73 @@
+package remotewrite
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/MOXA-ISD/edge-ha/pkg/internal/protowire"
+)
+
+// unmarshalWriteRequest decodes a request encoded by Marshal.
+func unmarshalWriteRequest(b []byte) (WriteRequest, error) {
+	req := WriteRequest{}
+	d := protowire.NewDecoder(b)
+	for !d.Done() {
+		field, wire, err := d.Key()
+		if err != nil {
+			return req, err
+		}
+		if field != 1 || wire != protowire.Bytes {
+			return req, fmt.Errorf("unexpected field %d of wire type %d", field, wire)
+		}
+		data, err := d.Bytes()
+		if err != nil {
+			return req, err
+		}
+		ts, err := UnmarshalTimeSeries(data)
+		if err != nil {
+			return req, err
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+	return req, nil
+}
+
+func TestTimeSeriesEncoding(t *testing.T) {
+	ts := TimeSeries{Labels: []Label{{"a", "b"}}, Samples: []Sample{{Value: 1, Timestamp: 2}}}
+	want := []byte{
+		0x0a, 0x06, 0x0a, 0x01, 'a', 0x12, 0x01, 'b',
+		0x12, 0x0b, 0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0x10, 0x02,
+	}
+	if got := ts.Marshal(); !bytes.Equal(got, want) {
+		t.Errorf("encoded % x\nwant % x", got, want)
+	}
+}
+
+func TestWriteRequestRoundTrip(t *testing.T) {
+	req := WriteRequest{Timeseries: []TimeSeries{
+		{
+			Labels: []Label{{"__name__", "edge_tag_value"}, {"device", "gw-01"}, {"tag", ""}},
+			Samples: []Sample{
+				{Value: 21.5, Timestamp: 1500000000000},
+				{Value: -1e300, Timestamp: -1},
+				{Value: math.Inf(1), Timestamp: 0},
+			},
+		},
+		{Labels: []Label{{"__name__", "up"}}},
+	}}
+	got, err := unmarshalWriteRequest(req.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("decoded %+v\nwant %+v", got, req)
+	}
+
+	data := req.Timeseries[0].Marshal()
+	if _, err := UnmarshalTimeSeries(data[:len(data)-1]); err == nil {
+		t.Error("no error decoding a truncated series")
+	}
+}
@@ -0,0 +1,42 @@
+package remotewrite
+
+import "encoding/binary"
+
+// maxLiteral keeps the literals well below the 64KiB blocks snappy
+// decoders work with.
+const maxLiteral = 1 << 16
+
+// snappyEncode encodes src as a snappy block made only of literals. The
+// remote_write protocol requires snappy framing of the body but not
+// compression, which keeps the exporter free of a snappy dependency at the
+// cost of a larger body.
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/maxLiteral*5+5)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+	for len(src) > 0 {
+		n := len(src)
+		if n > maxLiteral {
+			n = maxLiteral
+		}
+		dst = appendLiteral(dst, src[:n])
+		src = src[n:]
+	}
+	return dst
+}
+
+func appendLiteral(dst, lit []byte) []byte {
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n<<2))
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
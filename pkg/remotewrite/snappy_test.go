@@ -0,0 +1,30 @@
+package remotewrite
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestSnappyEncode(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	// around the literal length encodings and the literal size
+	for _, n := range []int{0, 1, 60, 61, 256, 257, 1 << 16, 1<<16 + 1, 200000} {
+		src := make([]byte, n)
+		rnd.Read(src)
+		enc := snappyEncode(src)
+		if l, err := snappy.DecodedLen(enc); err != nil || l != n {
+			t.Errorf("%d bytes: decoded length %d, %v", n, l, err)
+		}
+		dec, err := snappy.Decode(nil, enc)
+		if err != nil {
+			t.Errorf("%d bytes: %s", n, err)
+			continue
+		}
+		if !bytes.Equal(dec, src) {
+			t.Errorf("%d bytes: decoded block differs", n)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package remotewrite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	walSegmentSize = 8 << 20
+	walSuffix      = ".wal"
+)
+
+// wal spills the series the shards cannot keep up with to segment files
+// in dir. Records are appended to the newest segment, the older ones are
+// sealed and replayed in order, then removed. Every record is its length,
+// the crc32 of the data and the encoded series, a torn record at the end of
+// a segment ends it.
+type wal struct {
+	dir     string
+	maxSize int64
+
+	segments []int
+	sizes    map[int]int64
+	size     int64
+	active   *os.File
+	writer   *bufio.Writer
+	// reading is the segment being replayed, -1 when none, it is never
+	// removed to reclaim space
+	reading int
+}
+
+func openWAL(dir string, maxSize int64) (*wal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &wal{dir: dir, maxSize: maxSize, sizes: map[int]int64{}, reading: -1}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), walSuffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(f.Name(), walSuffix))
+		if err != nil {
+			continue
+		}
+		w.segments = append(w.segments, n)
+		w.sizes[n] = f.Size()
+		w.size += f.Size()
+	}
+	sort.Ints(w.segments)
+	return w, nil
+}
+
+func (w *wal) path(segment int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d%s", segment, walSuffix))
+}
+
+// Empty reports whether the wal holds no record.
+func (w *wal) Empty() bool {
+	return w.size == 0
+}
+
+// Append writes a series to the active segment and returns the number of
+// samples removed to stay under the size limit.
+func (w *wal) Append(ts *TimeSeries) (int, error) {
+	data := ts.Marshal()
+	if w.active == nil || w.sizes[w.last()] >= walSegmentSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(data))
+	if _, err := w.writer.Write(header[:]); err != nil {
+		return 0, err
+	}
+	if _, err := w.writer.Write(data); err != nil {
+		return 0, err
+	}
+	n := int64(len(header) + len(data))
+	w.sizes[w.last()] += n
+	w.size += n
+	return w.truncate(), nil
+}
+
+// Next returns the oldest segment to replay, the active segment is sealed
+// when it is the last one left. The segment is kept until it is removed.
+func (w *wal) Next() (int, bool, error) {
+	if len(w.segments) == 0 {
+		return 0, false, nil
+	}
+	segment := w.segments[0]
+	if w.active != nil && segment == w.last() {
+		if err := w.closeActive(); err != nil {
+			return 0, false, err
+		}
+	}
+	w.reading = segment
+	return segment, true, nil
+}
+
+// Read decodes the records of a sealed segment.
+func (w *wal) Read(segment int, fn func(TimeSeries)) error {
+	f, err := os.Open(w.path(segment))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[:4]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil
+		}
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+			return fmt.Errorf("remotewrite: corrupted record in %s", w.path(segment))
+		}
+		ts, err := UnmarshalTimeSeries(data)
+		if err != nil {
+			return err
+		}
+		fn(ts)
+	}
+}
+
+// Remove deletes a replayed segment.
+func (w *wal) Remove(segment int) error {
+	if segment == w.reading {
+		w.reading = -1
+	}
+	for i, s := range w.segments {
+		if s == segment {
+			w.segments = append(w.segments[:i], w.segments[i+1:]...)
+			break
+		}
+	}
+	w.size -= w.sizes[segment]
+	delete(w.sizes, segment)
+	return os.Remove(w.path(segment))
+}
+
+// Close flushes and closes the active segment.
+func (w *wal) Close() error {
+	if w.active == nil {
+		return nil
+	}
+	return w.closeActive()
+}
+
+func (w *wal) last() int {
+	if len(w.segments) == 0 {
+		return -1
+	}
+	return w.segments[len(w.segments)-1]
+}
+
+func (w *wal) rotate() error {
+	if w.active != nil {
+		if err := w.closeActive(); err != nil {
+			return err
+		}
+	}
+	segment := w.last() + 1
+	f, err := os.OpenFile(w.path(segment), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w.segments = append(w.segments, segment)
+	w.sizes[segment] = 0
+	w.active = f
+	w.writer = bufio.NewWriter(f)
+	return nil
+}
+
+func (w *wal) closeActive() error {
+	err := w.writer.Flush()
+	if cerr := w.active.Close(); err == nil {
+		err = cerr
+	}
+	w.active, w.writer = nil, nil
+	return err
+}
+
+// truncate removes the oldest sealed segments while the wal is over its
+// size limit, it returns the number of samples they held.
+func (w *wal) truncate() int {
+	dropped := 0
+	for w.maxSize > 0 && w.size > w.maxSize {
+		segment := -1
+		for _, s := range w.segments {
+			if s != w.reading && (w.active == nil || s != w.last()) {
+				segment = s
+				break
+			}
+		}
+		if segment < 0 {
+			break
+		}
+		w.Read(segment, func(ts TimeSeries) { dropped += len(ts.Samples) })
+		w.Remove(segment)
+	}
+	return dropped
+}
@@ -0,0 +1,136 @@
+package remotewrite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testSeries(i int) TimeSeries {
+	return TimeSeries{
+		Labels:  []Label{{"__name__", "edge_tag_value"}, {"device", "gw-01"}},
+		Samples: []Sample{{Value: float64(i), Timestamp: int64(i)}},
+	}
+}
+
+func walFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+walSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestWALReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := openWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		ts := testSeries(i)
+		if _, err := w.Append(&ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records survive a restart and are appended to in a new segment
+	w, err = openWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Empty() {
+		t.Fatal("reopened wal is empty")
+	}
+	ts := testSeries(3)
+	if _, err := w.Append(&ts); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(walFiles(t, dir)); n != 2 {
+		t.Errorf("%d segments, want 2", n)
+	}
+
+	var got []TimeSeries
+	for !w.Empty() {
+		segment, ok, err := w.Next()
+		if err != nil || !ok {
+			t.Fatalf("next segment: %v %v", ok, err)
+		}
+		if err := w.Read(segment, func(ts TimeSeries) { got = append(got, ts) }); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Remove(segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []TimeSeries{testSeries(0), testSeries(1), testSeries(2), testSeries(3)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %+v\nwant %+v", got, want)
+	}
+	if files := walFiles(t, dir); len(files) != 0 {
+		t.Errorf("segments left after the replay: %v", files)
+	}
+}
+
+func TestWALTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// one sealed segment of two records
+	w, err := openWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		ts := testSeries(i)
+		w.Append(&ts)
+	}
+	w.Close()
+	sealed := w.size
+
+	w, err = openWAL(dir, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := testSeries(2)
+	dropped, err := w.Append(&ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 2 {
+		t.Errorf("%d samples dropped, want 2", dropped)
+	}
+	if w.size > sealed {
+		t.Errorf("size %d over the limit %d", w.size, sealed)
+	}
+	// the active segment is kept even over the limit
+	for i := 3; i < 5; i++ {
+		ts = testSeries(i)
+		if dropped, _ := w.Append(&ts); dropped != 0 {
+			t.Errorf("%d samples dropped from the active segment", dropped)
+		}
+	}
+	if w.size <= sealed {
+		t.Fatalf("size %d not over the limit %d", w.size, sealed)
+	}
+	segment, _, _ := w.Next()
+	var got []TimeSeries
+	w.Read(segment, func(ts TimeSeries) { got = append(got, ts) })
+	if want := []TimeSeries{testSeries(2), testSeries(3), testSeries(4)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %+v\nwant %+v", got, want)
+	}
+}
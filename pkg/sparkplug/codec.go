@@ -0,0 +1,175 @@
+package sparkplug
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/MOXA-ISD/edge-ha/pkg/internal/protowire"
+)
+
+// Marshal encodes the payload in protobuf wire format.
+func (p *Payload) Marshal() []byte {
+	e := &protowire.Encoder{}
+	if p.Timestamp != 0 {
+		e.Uint(1, p.Timestamp)
+	}
+	for i := range p.Metrics {
+		e.Bytes(2, p.Metrics[i].marshal())
+	}
+	if p.HasSeq {
+		e.Uint(3, p.Seq)
+	}
+	if p.UUID != "" {
+		e.Bytes(4, []byte(p.UUID))
+	}
+	if p.Body != nil {
+		e.Bytes(5, p.Body)
+	}
+	return e.Buf
+}
+
+func (m *Metric) marshal() []byte {
+	e := &protowire.Encoder{}
+	if m.Name != "" {
+		e.Bytes(1, []byte(m.Name))
+	}
+	if m.HasAlias {
+		e.Uint(2, m.Alias)
+	}
+	if m.Timestamp != 0 {
+		e.Uint(3, m.Timestamp)
+	}
+	e.Uint(4, uint64(m.Datatype))
+	if m.Historical {
+		e.Uint(5, 1)
+	}
+	if m.Transient {
+		e.Uint(6, 1)
+	}
+	if m.IsNull {
+		e.Uint(7, 1)
+		return e.Buf
+	}
+	switch v := m.Value.(type) {
+	case uint32:
+		e.Uint(10, uint64(v))
+	case uint64:
+		e.Uint(11, v)
+	case float32:
+		e.Fixed32(12, math.Float32bits(v))
+	case float64:
+		e.Fixed64(13, math.Float64bits(v))
+	case bool:
+		if v {
+			e.Uint(14, 1)
+		} else {
+			e.Uint(14, 0)
+		}
+	case string:
+		e.Bytes(15, []byte(v))
+	case []byte:
+		e.Bytes(16, v)
+	}
+	return e.Buf
+}
+
+// Unmarshal decodes a protobuf encoded payload, unknown fields are skipped.
+func Unmarshal(data []byte) (*Payload, error) {
+	p := &Payload{}
+	d := protowire.NewDecoder(data)
+	for !d.Done() {
+		field, wire, err := d.Key()
+		if err != nil {
+			return nil, fmt.Errorf("sparkplug: %s", err)
+		}
+		switch {
+		case field == 1 && wire == protowire.Varint:
+			p.Timestamp, err = d.Varint()
+		case field == 2 && wire == protowire.Bytes:
+			var b []byte
+			if b, err = d.Bytes(); err == nil {
+				var m Metric
+				if m, err = unmarshalMetric(b); err == nil {
+					p.Metrics = append(p.Metrics, m)
+				}
+			}
+		case field == 3 && wire == protowire.Varint:
+			p.Seq, err = d.Varint()
+			p.HasSeq = true
+		case field == 4 && wire == protowire.Bytes:
+			var b []byte
+			b, err = d.Bytes()
+			p.UUID = string(b)
+		case field == 5 && wire == protowire.Bytes:
+			p.Body, err = d.Bytes()
+		default:
+			err = d.Skip(wire)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sparkplug: %s", err)
+		}
+	}
+	return p, nil
+}
+
+func unmarshalMetric(data []byte) (Metric, error) {
+	var m Metric
+	d := protowire.NewDecoder(data)
+	for !d.Done() {
+		field, wire, err := d.Key()
+		if err != nil {
+			return m, err
+		}
+		var v uint64
+		switch {
+		case field == 1 && wire == protowire.Bytes:
+			var b []byte
+			b, err = d.Bytes()
+			m.Name = string(b)
+		case field == 2 && wire == protowire.Varint:
+			m.Alias, err = d.Varint()
+			m.HasAlias = true
+		case field == 3 && wire == protowire.Varint:
+			m.Timestamp, err = d.Varint()
+		case field == 4 && wire == protowire.Varint:
+			v, err = d.Varint()
+			m.Datatype = uint32(v)
+		case field == 5 && wire == protowire.Varint:
+			v, err = d.Varint()
+			m.Historical = v != 0
+		case field == 6 && wire == protowire.Varint:
+			v, err = d.Varint()
+			m.Transient = v != 0
+		case field == 7 && wire == protowire.Varint:
+			v, err = d.Varint()
+			m.IsNull = v != 0
+		case field == 10 && wire == protowire.Varint:
+			v, err = d.Varint()
+			m.Value = uint32(v)
+		case field == 11 && wire == protowire.Varint:
+			m.Value, err = d.Varint()
+		case field == 12 && wire == protowire.Fixed32:
+			var u uint32
+			u, err = d.Fixed32()
+			m.Value = math.Float32frombits(u)
+		case field == 13 && wire == protowire.Fixed64:
+			v, err = d.Fixed64()
+			m.Value = math.Float64frombits(v)
+		case field == 14 && wire == protowire.Varint:
+			v, err = d.Varint()
+			m.Value = v != 0
+		case field == 15 && wire == protowire.Bytes:
+			var b []byte
+			b, err = d.Bytes()
+			m.Value = string(b)
+		case field == 16 && wire == protowire.Bytes:
+			m.Value, err = d.Bytes()
+		default:
+			err = d.Skip(wire)
+		}
+		if err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
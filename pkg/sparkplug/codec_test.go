@@ -0,0 +1,77 @@
+package sparkplug
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPayloadRoundTrip(t *testing.T) {
+	p := &Payload{
+		Timestamp: 1500000000000,
+		Seq:       0,
+		HasSeq:    true,
+		UUID:      "edge-ha",
+		Body:      []byte{0, 1, 2},
+		Metrics: []Metric{
+			NewMetric(BdSeqMetric, UInt64, 3),
+			NewMetric("temp", Float, 21.5),
+			NewMetric("pressure", Double, -1.25),
+			NewMetric("count", Int32, -7),
+			NewMetric("running", Boolean, true),
+			NewMetric("stopped", Boolean, false),
+			NewMetric("mode", String, "auto"),
+			NewMetric("blob", Bytes, []byte("raw")),
+			NewMetric("unset", Int16, nil),
+			{Alias: 4, HasAlias: true, Timestamp: 1500000000001, Datatype: UInt8, Historical: true, Transient: true, Value: uint32(200)},
+			{Alias: 0, HasAlias: true, Datatype: UInt64, Value: uint64(1) << 63},
+		},
+	}
+	got, err := Unmarshal(p.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("decoded %+v\nwant %+v", got, p)
+	}
+
+	// a payload without seq, timestamp nor metrics stays empty
+	got, err = Unmarshal((&Payload{}).Marshal())
+	if err != nil || !reflect.DeepEqual(got, &Payload{}) {
+		t.Errorf("decoded %+v, %v", got, err)
+	}
+
+	data := p.Marshal()
+	if _, err := Unmarshal(data[:len(data)-1]); err == nil {
+		t.Error("no error decoding a truncated payload")
+	}
+}
+
+func TestMetricFloat64(t *testing.T) {
+	for _, tc := range []struct {
+		m    Metric
+		want float64
+		ok   bool
+	}{
+		{NewMetric("a", Int8, -1), -1, true},
+		{NewMetric("a", Int16, -300), -300, true},
+		{NewMetric("a", Int32, -70000), -70000, true},
+		{NewMetric("a", Int64, -1), -1, true},
+		{NewMetric("a", UInt32, 4000000000), 4000000000, true},
+		{NewMetric("a", Float, 0.5), 0.5, true},
+		{NewMetric("a", Boolean, true), 1, true},
+		{NewMetric("a", String, "1"), 0, false},
+		{NewMetric("a", Double, nil), 0, false},
+	} {
+		// the value is read back from the wire, where signed types are
+		// carried unsigned
+		p := &Payload{Metrics: []Metric{tc.m}}
+		decoded, err := Unmarshal(p.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, ok := decoded.Metrics[0].Float64()
+		if v != tc.want || ok != tc.ok {
+			t.Errorf("datatype %d value %v: %v %v, want %v %v", tc.m.Datatype, tc.m.Value, v, ok, tc.want, tc.ok)
+		}
+	}
+}
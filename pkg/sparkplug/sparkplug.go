@@ -0,0 +1,202 @@
+// Package sparkplug implements the parts of the Sparkplug B specification
+// used by ha-slave and the exporter: topic naming and the protobuf payload.
+package sparkplug
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Namespace is the first topic level of every Sparkplug B message.
+const Namespace = "spBv1.0"
+
+// Message types, the third topic level.
+const (
+	NBIRTH = "NBIRTH"
+	NDEATH = "NDEATH"
+	NDATA  = "NDATA"
+	NCMD   = "NCMD"
+	DBIRTH = "DBIRTH"
+	DDEATH = "DDEATH"
+	DDATA  = "DDATA"
+	DCMD   = "DCMD"
+	STATE  = "STATE"
+)
+
+// Well known metric names.
+const (
+	BdSeqMetric   = "bdSeq"
+	RebirthMetric = "Node Control/Rebirth"
+)
+
+// Metric data types.
+const (
+	Int8     uint32 = 1
+	Int16    uint32 = 2
+	Int32    uint32 = 3
+	Int64    uint32 = 4
+	UInt8    uint32 = 5
+	UInt16   uint32 = 6
+	UInt32   uint32 = 7
+	UInt64   uint32 = 8
+	Float    uint32 = 9
+	Double   uint32 = 10
+	Boolean  uint32 = 11
+	String   uint32 = 12
+	DateTime uint32 = 13
+	Text     uint32 = 14
+	UUID     uint32 = 15
+	Bytes    uint32 = 17
+)
+
+// Topic is a parsed spBv1.0/{group}/{type}/{node}[/{device}] topic.
+type Topic struct {
+	Group  string
+	Type   string
+	Node   string
+	Device string
+}
+
+// ParseTopic splits a Sparkplug B topic into its parts.
+func ParseTopic(topic string) (Topic, error) {
+	arr := strings.Split(topic, "/")
+	if len(arr) < 4 || len(arr) > 5 || arr[0] != Namespace {
+		return Topic{}, fmt.Errorf("not a sparkplug topic: %s", topic)
+	}
+	t := Topic{Group: arr[1], Type: arr[2], Node: arr[3]}
+	if len(arr) == 5 {
+		t.Device = arr[4]
+	}
+	return t, nil
+}
+
+func (t Topic) String() string {
+	topic := strings.Join([]string{Namespace, t.Group, t.Type, t.Node}, "/")
+	if t.Device != "" {
+		topic += "/" + t.Device
+	}
+	return topic
+}
+
+// Payload is the Sparkplug B Payload message.
+type Payload struct {
+	Timestamp uint64
+	Metrics   []Metric
+	Seq       uint64
+	HasSeq    bool
+	UUID      string
+	Body      []byte
+}
+
+// Metric is the Sparkplug B Payload.Metric message. Value holds one of
+// uint32, uint64, float32, float64, bool, string or []byte depending on the
+// data type, datasets and templates are not supported.
+type Metric struct {
+	Name       string
+	Alias      uint64
+	HasAlias   bool
+	Timestamp  uint64
+	Datatype   uint32
+	Historical bool
+	Transient  bool
+	IsNull     bool
+	Value      interface{}
+}
+
+// NewMetric builds a metric from a go value using the given data type.
+func NewMetric(name string, datatype uint32, v interface{}) Metric {
+	m := Metric{Name: name, Datatype: datatype}
+	if v == nil {
+		m.IsNull = true
+		return m
+	}
+	switch datatype {
+	case Int8, Int16, Int32, UInt8, UInt16, UInt32:
+		m.Value = uint32(toInt64(v))
+	case Int64, UInt64, DateTime:
+		m.Value = uint64(toInt64(v))
+	case Float:
+		m.Value = float32(toFloat64(v))
+	case Double:
+		m.Value = toFloat64(v)
+	case Boolean:
+		b, _ := v.(bool)
+		m.Value = b
+	case String, Text, UUID:
+		m.Value = fmt.Sprint(v)
+	case Bytes:
+		b, _ := v.([]byte)
+		m.Value = b
+	default:
+		m.IsNull = true
+	}
+	return m
+}
+
+// Float64 returns the metric value as a number, booleans map to 0/1.
+func (m Metric) Float64() (float64, bool) {
+	if m.IsNull {
+		return 0, false
+	}
+	switch v := m.Value.(type) {
+	case uint32:
+		switch m.Datatype {
+		case Int8:
+			return float64(int8(v)), true
+		case Int16:
+			return float64(int16(v)), true
+		case Int32:
+			return float64(int32(v)), true
+		}
+		return float64(v), true
+	case uint64:
+		if m.Datatype == Int64 {
+			return float64(int64(v)), true
+		}
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case uint32:
+		return int64(n)
+	case uint64:
+		return int64(n)
+	case float32:
+		return int64(n)
+	case float64:
+		return int64(n)
+	case bool:
+		if n {
+			return 1
+		}
+	}
+	return 0
+}
+
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case float32:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return float64(toInt64(v))
+}